@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/store"
+)
+
+var adminToken atomic.Pointer[string]
+
+// Called with the repo name of a snake removed through the admin api
+var snakeRemovedHook atomic.Pointer[func(repoName string)]
+
+// Set the bearer token required by the admin api. An empty token disables
+// the admin api.
+func SetAdminToken(token string) {
+	adminToken.Store(&token)
+}
+
+// Set what is done after a snake is removed through the admin api, such as
+// forgetting its settings so that reloading the config adds it again
+func SetSnakeRemovedHook(hook func(repoName string)) {
+	snakeRemovedHook.Store(&hook)
+}
+
+func registerAdminHandlers(r *mux.Router) {
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuth)
+
+	admin.HandleFunc("/snakes", adminListSnakes).Methods("GET")
+	admin.HandleFunc("/snakes/{id}", adminGetSnake).Methods("GET")
+	admin.HandleFunc("/snakes/{id}", adminRemoveSnake).Methods("DELETE")
+	admin.HandleFunc("/snakes/{id}/start", adminContainerAction(docker.EnsureContainerRunning)).Methods("POST")
+	admin.HandleFunc("/snakes/{id}/stop", adminContainerAction(docker.StopContainer)).Methods("POST")
+	admin.HandleFunc("/snakes/{id}/pause", adminContainerAction(docker.PauseContainer)).Methods("POST")
+	admin.HandleFunc("/snakes/{id}/unpause", adminContainerAction(docker.UnpauseContainer)).Methods("POST")
+	admin.HandleFunc("/snakes/{id}/deploy", adminDeploySnake).Methods("POST")
+	admin.HandleFunc("/snakes/{id}/images", adminListImages).Methods("GET")
+	admin.HandleFunc("/snakes/{id}/rollback", adminRollbackSnake).Methods("POST")
+	admin.HandleFunc("/snakes/{id}/deploys/{deploy}/log", adminDeployLog).Methods("GET")
+	admin.HandleFunc("/snakes/{id}/games", adminListGames).Methods("GET")
+	admin.HandleFunc("/snakes/{id}/games/{game}", adminDownloadGame).Methods("GET")
+	admin.HandleFunc("/snakes/{id}/replay", adminReplaySnake).Methods("POST")
+	admin.HandleFunc("/jobs", adminListJobs).Methods("GET")
+	admin.HandleFunc("/jobs/{id}", adminGetJob).Methods("GET")
+	admin.HandleFunc("/jobs/{id}/log", adminJobLog).Methods("GET")
+	admin.HandleFunc("/jobs/{id}/cancel", adminCancelJob).Methods("POST")
+}
+
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if stored := adminToken.Load(); stored != nil {
+			token = *stored
+		}
+		if token == "" {
+			writeJsonError(w, 403, "The admin api is disabled")
+			return
+		}
+
+		given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJsonError(w, 401, "Access Denied")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+// Respond with the error of a docker operation
+func writeDockerError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case docker.ErrorNotRegistered:
+		writeJsonError(w, 404, "Snake not found")
+	case docker.ErrorDoesNotExist:
+		writeJsonError(w, 409, "The container does not exist")
+	case docker.ErrorConflict:
+		writeJsonError(w, 409, err.Error())
+	default:
+		slog.ErrorContext(r.Context(), "Docker operation failed", "path", r.URL.Path, "error", err)
+		writeJsonError(w, 500, err.Error())
+	}
+}
+
+type snakeInfo struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Container   string            `json:"container"`
+	Running     bool              `json:"running"`
+	Paused      bool              `json:"paused"`
+	Exists      bool              `json:"exists"`
+	Ready       bool              `json:"ready"`
+	Health      string            `json:"health,omitempty"`
+	IPAddress   string            `json:"ip_address,omitempty"`
+	Image       string            `json:"image"`
+	LastUsed    *time.Time        `json:"last_used"`
+	LastUpdate  *time.Time        `json:"last_update"`
+	ActiveGames int               `json:"active_games"`
+	Options     docker.RunOptions `json:"run"`
+	Commit      string            `json:"commit,omitempty"`
+	ImageID     string            `json:"image_id,omitempty"`
+	DeployedAt  *time.Time        `json:"deployed_at,omitempty"`
+	Deploys     []store.Deploy    `json:"deploys"`
+	Deploying   bool              `json:"deploying"`
+}
+
+func newSnakeInfo(name string, state docker.ContainerState) snakeInfo {
+	saved, _ := store.Get(name)
+	deploying := false
+	if conf := getBuildConfig(state.RepoName); conf != nil {
+		if conf.BuildingMutex.TryLock() {
+			conf.BuildingMutex.Unlock()
+		} else {
+			deploying = true
+		}
+	}
+	deploys := saved.Deploys
+	if deploys == nil {
+		deploys = []store.Deploy{}
+	}
+	return snakeInfo{
+		ID:          strings.TrimPrefix(name, "bs-"),
+		Name:        state.RepoName,
+		Container:   name,
+		Running:     state.Running,
+		Paused:      state.Paused,
+		Exists:      state.Exists,
+		Ready:       state.Ready,
+		Health:      state.Health,
+		IPAddress:   state.IPAddress,
+		Image:       state.Image,
+		LastUsed:    state.LastUsed,
+		LastUpdate:  state.LastUpdate,
+		ActiveGames: docker.ActiveGames(name),
+		Options:     state.Options,
+		Commit:      saved.Commit,
+		ImageID:     saved.ImageID,
+		DeployedAt:  saved.DeployedAt,
+		Deploys:     deploys,
+		Deploying:   deploying,
+	}
+}
+
+func adminListSnakes(w http.ResponseWriter, r *http.Request) {
+	states := map[string]docker.ContainerState{}
+	docker.IterContainers(func(name string, container docker.ContainerState) bool {
+		states[name] = container
+		return true
+	})
+
+	result := []snakeInfo{}
+	for name, state := range states {
+		result = append(result, newSnakeInfo(name, state))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	writeJson(w, 200, result)
+}
+
+func adminGetSnake(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	state, err := docker.GetState(id)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	writeJson(w, 200, newSnakeInfo(id, state))
+}
+
+func adminContainerAction(action func(ctx context.Context, name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := "bs-" + mux.Vars(r)["id"]
+		if err := action(r.Context(), id); err != nil {
+			writeDockerError(w, r, err)
+			return
+		}
+		adminGetSnake(w, r)
+	}
+}
+
+// Queue a deploy of the default branch, or the branch, tag or commit given
+// by `ref`
+func adminDeploySnake(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	state, err := docker.GetState(id)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if strings.HasPrefix(ref, "-") {
+		writeJsonError(w, 400, "Invalid ref")
+		return
+	}
+	job, err := enqueueDeploy(state.RepoName, ref, triggerAdmin)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	writeJson(w, 202, job)
+}
+
+// Stop and delete a snake's container and forget about the snake and its
+// games. The snake is added again the next time the config is reloaded if it
+// is still listed.
+func adminRemoveSnake(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	state, err := docker.GetState(id)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+
+	err = docker.RemoveContainer(id, true)
+	if err != nil && err != docker.ErrorDoesNotExist {
+		writeDockerError(w, r, err)
+		return
+	}
+	UnregisterRepo(state.RepoName)
+	docker.UnregisterContainer(state.RepoName)
+	docker.ForgetGames(id)
+	forgetUpstream(id)
+	if hook := snakeRemovedHook.Load(); hook != nil {
+		(*hook)(state.RepoName)
+	}
+
+	w.WriteHeader(204)
+}
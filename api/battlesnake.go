@@ -1,85 +1,370 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/games"
+	"github.com/ttocsneb/battlesnake-manager/logging"
+	"github.com/ttocsneb/battlesnake-manager/rules"
+)
+
+// The paths requests are sent to on a snake. Replays use the same paths so
+// that a snake behaves the same as when it is played through the proxy.
+const (
+	snakeInfoPath  = "/"
+	snakeStartPath = "/start/"
+	snakeMovePath  = "/move/"
+	snakeEndPath   = "/end/"
 )
 
 func registerBattleSnakeRoutes(r *mux.Router) {
-	r.HandleFunc("/bs/{id}", battleSnakePoxyHandler("/"))
-	r.HandleFunc("/bs/{id}/", battleSnakePoxyHandler("/"))
+	r.HandleFunc("/bs/{id}", battleSnakePoxyHandler(snakeInfoPath))
+	r.HandleFunc("/bs/{id}/", battleSnakePoxyHandler(snakeInfoPath))
 
-	r.HandleFunc("/bs/{id}/start", battleSnakePoxyHandler("/start/"))
-	r.HandleFunc("/bs/{id}/start/", battleSnakePoxyHandler("/start/"))
+	r.HandleFunc("/bs/{id}/start", battleSnakePoxyHandler(snakeStartPath))
+	r.HandleFunc("/bs/{id}/start/", battleSnakePoxyHandler(snakeStartPath))
 
-	r.HandleFunc("/bs/{id}/move", battleSnakePoxyHandler("/move/"))
-	r.HandleFunc("/bs/{id}/move/", battleSnakePoxyHandler("/move/"))
+	r.HandleFunc("/bs/{id}/move", battleSnakePoxyHandler(snakeMovePath))
+	r.HandleFunc("/bs/{id}/move/", battleSnakePoxyHandler(snakeMovePath))
 
-	r.HandleFunc("/bs/{id}/end", battleSnakePoxyHandler("/end/"))
-	r.HandleFunc("/bs/{id}/end/", battleSnakePoxyHandler("/end/"))
+	r.HandleFunc("/bs/{id}/end", battleSnakePoxyHandler(snakeEndPath))
+	r.HandleFunc("/bs/{id}/end/", battleSnakePoxyHandler(snakeEndPath))
 }
 
-func ensureContainerRunning(w http.ResponseWriter, r *http.Request, id string) (string, bool) {
-	err := docker.EnsureContainerRunning(id)
+// How long to wait for a snake to become ready before giving up
+const readyTimeout time.Duration = 30 * time.Second
+
+func ensureContainerRunning(ctx context.Context, id string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	err := docker.EnsureContainerReady(ctx, id)
 	if err != nil {
-		if err == docker.ErrorNotRegistered {
-			notFound(w, r)
-			return "", false
-		}
-		logError(w, r, "Could not start container", err)
-		return "", false
+		return "", err
 	}
 
 	// ignore the error since it can never fail after ensuring the container is running
 	state, _ := docker.GetState(id)
-	return state.IPAddress, true
+	return state.Address(), nil
+}
+
+// The parts of a battlesnake request that the manager cares about
+type gameRequest struct {
+	Game struct {
+		ID      string `json:"id"`
+		Timeout int    `json:"timeout"`
+	} `json:"game"`
+	Turn int `json:"turn"`
+}
+
+// Parse the game out of a request body. ok is false if there is no game.
+func parseGame(body []byte) (game gameRequest, ok bool) {
+	if len(body) == 0 {
+		return game, false
+	}
+	if err := json.Unmarshal(body, &game); err != nil || game.Game.ID == "" {
+		return game, false
+	}
+	return game, true
+}
+
+// Keep track of which games the snake is playing so that it is kept running
+// for the whole game
+func trackGame(id string, path string, game gameRequest) {
+	switch path {
+	case snakeStartPath:
+		timeout := time.Duration(game.Game.Timeout) * time.Millisecond
+		docker.StartGame(id, game.Game.ID, timeout)
+	case snakeMovePath:
+		docker.TouchGame(id, game.Game.ID)
+	case snakeEndPath:
+		docker.EndGame(id, game.Game.ID)
+	}
+}
+
+// The kind of game record a proxy path produces, empty if it is not part of
+// a game
+func recordType(path string) string {
+	switch path {
+	case snakeStartPath:
+		return games.RecordStart
+	case snakeMovePath:
+		return games.RecordMove
+	case snakeEndPath:
+		return games.RecordEnd
+	}
+	return ""
+}
+
+// The game recording settings of a container
+func recordSettings(id string) games.Settings {
+	state, err := docker.GetState(id)
+	if err != nil {
+		return games.Settings{}
+	}
+	conf := getBuildConfig(state.RepoName)
+	if conf == nil {
+		return games.Settings{}
+	}
+	return conf.settings().Record
+}
+
+// The largest response that is kept in a game record. A larger move is
+// answered with a fallback.
+const maxRecordedResponse int = 64 * 1024
+
+var ErrorMoveTooLarge = errors.New("The move response is too large")
+
+// A buffer that drops everything once it has grown too large
+type cappedBuffer struct {
+	bytes.Buffer
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || b.Len()+len(p) > maxRecordedResponse {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// The name of the endpoint a proxy path is for
+func endpointName(path string) string {
+	name := strings.Trim(path, "/")
+	if name == "" {
+		return "info"
+	}
+	return name
+}
+
+// How long before the game's move timeout the proxy gives up on the snake
+// and answers with a fallback move
+const moveSafetyMargin time.Duration = 60 * time.Millisecond
+
+// The move timeout when a request does not include one
+const defaultGameTimeout time.Duration = 500 * time.Millisecond
+
+// Pick a move for the snake when it could not answer in time, avoiding
+// walls, bodies and likely head-to-head losses where possible
+func fallbackMove(body []byte) string {
+	state, err := rules.ParseGameState(body)
+	if err != nil {
+		return rules.MoveUp
+	}
+	if moves := state.SafeMoves(); len(moves) > 0 {
+		return moves[0]
+	}
+	return rules.MoveUp
 }
 
 func battleSnakePoxyHandler(path string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		id := "bs-" + mux.Vars(r)["id"]
-		ip, running := ensureContainerRunning(w, r, id)
-		if !running {
+		ctx := logging.With(r.Context(), "snake", id, "endpoint", endpointName(path))
+		r = r.WithContext(ctx)
+		if !docker.IsRegistered(id) {
+			notFound(w, r)
+			return
+		}
+
+		// Wake up the container while the request body is still being read.
+		// A move that is answered with a fallback does not abort the start.
+		type ensureResult struct {
+			addr string
+			err  error
+		}
+		ready := make(chan ensureResult, 1)
+		if addr, ok := docker.ReadyAddress(id); ok {
+			ready <- ensureResult{addr, nil}
+		} else {
+			go func() {
+				addr, err := ensureContainerRunning(context.WithoutCancel(ctx), id)
+				ready <- ensureResult{addr, err}
+			}()
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logError(w, r, "Could not read request", err)
+			return
+		}
+		game, isGame := parseGame(body)
+		var record games.Settings
+		if isGame {
+			trackGame(id, path, game)
+			if recordType(path) != "" {
+				record = recordSettings(id)
+			}
+			ctx = logging.With(ctx, "game_id", game.Game.ID, "turn", game.Turn)
+			r = r.WithContext(ctx)
+		}
+
+		// Moves have to be answered before the game's timeout
+		isMove := isGame && path == snakeMovePath
+		upstreamCtx := ctx
+		if isMove {
+			timeout := time.Duration(game.Game.Timeout) * time.Millisecond
+			if timeout <= 0 {
+				timeout = defaultGameTimeout
+			}
+			var cancel context.CancelFunc
+			upstreamCtx, cancel = context.WithDeadline(ctx, start.Add(timeout-moveSafetyMargin))
+			defer cancel()
+		}
+
+		upstreamStart := time.Now()
+		var upstreamTime time.Duration
+		finish := func(status int, response []byte, fallback bool) {
+			if record.Enabled {
+				games.Write(id, game.Game.ID, record, games.Record{
+					Type:      recordType(path),
+					Time:      upstreamStart,
+					Turn:      game.Turn,
+					Status:    status,
+					LatencyMs: float64(time.Since(upstreamStart)) / float64(time.Millisecond),
+					Request:   body,
+					Response:  games.Body(response),
+					Fallback:  fallback,
+				})
+			}
+			done := time.Since(start)
+			slog.InfoContext(ctx, "Proxied request", "status", status, "latency_ms", float64(done)/float64(time.Millisecond), "fallback", fallback)
+			proxyLatencyMetric.Observe(done.Seconds(), id, endpointName(path))
+			if !fallback {
+				proxyOverheadMetric.Observe((done - upstreamTime).Seconds(), id, endpointName(path))
+			}
+
+			// Let the docker job know that this battle snake has just been used
+			go func() {
+				docker.UpdateUsed(id)
+			}()
+		}
+		answerFallback := func(reason error) {
+			move := fallbackMove(body)
+			slog.WarnContext(ctx, "Answered with a fallback move", "move", move, "reason", reason)
+			fallbackMovesMetric.Inc(id)
+			response, _ := json.Marshal(rules.MoveResponse{Move: move})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write(response)
+			finish(200, response, true)
+		}
+
+		var result ensureResult
+		select {
+		case result = <-ready:
+		case <-upstreamCtx.Done():
+			if isMove {
+				answerFallback(errors.New("The snake did not start in time"))
+			}
+			return
+		}
+		if result.err != nil {
+			if result.err == docker.ErrorNotRegistered {
+				notFound(w, r)
+				return
+			}
+			if isMove {
+				answerFallback(result.err)
+				return
+			}
+			if result.err == docker.ErrorNotReady {
+				notReady(w, r)
+				return
+			}
+			logError(w, r, "Could not start container", result.err)
 			return
 		}
 
 		// Proxy the request to the battle snake
-		req, err := http.NewRequest(r.Method, fmt.Sprintf("http://%v%v", ip, path), r.Body)
+		req, err := http.NewRequestWithContext(upstreamCtx, r.Method, fmt.Sprintf("http://%v%v", result.addr, path), bytes.NewReader(body))
 		if err != nil {
 			logError(w, r, "Could not create pass-through request", err)
 			return
 		}
-		resp, err := http.DefaultClient.Do(req)
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		snake := getUpstream(id, result.addr)
+		if path == snakeStartPath {
+			snake.predial(predialConnections)
+		}
+		release := docker.BeginRequest(result.addr)
+		defer release()
+		upstreamStart = time.Now()
+		resp, err := snake.do(req)
 		if err != nil {
+			if isMove {
+				answerFallback(err)
+				return
+			}
 			logError(w, r, "Could not perform pass-through request", err)
 			return
 		}
 		defer resp.Body.Close()
 
+		// A move is read completely so that a fallback can still be sent if
+		// the snake fails
+		var response []byte
+		if isMove {
+			response, err = io.ReadAll(io.LimitReader(resp.Body, int64(maxRecordedResponse)+1))
+			if err == nil && resp.StatusCode != 200 {
+				err = fmt.Errorf("Returned Status Code %v", resp.StatusCode)
+			}
+			if err == nil && len(response) > maxRecordedResponse {
+				err = ErrorMoveTooLarge
+			}
+			if err != nil {
+				answerFallback(err)
+				return
+			}
+			upstreamTime = time.Since(upstreamStart)
+		}
+
 		// Respond to the original request with the proxied response
 		for k, vs := range resp.Header {
 			for _, v := range vs {
 				w.Header().Add(k, v)
 			}
 		}
+		if isMove {
+			// The move was read completely, the snake's framing no longer
+			// applies
+			w.Header().Del("Transfer-Encoding")
+			w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+		}
 		w.WriteHeader(resp.StatusCode)
-		_, err = io.Copy(w, resp.Body)
+		if isMove {
+			_, err = w.Write(response)
+		} else {
+			var captured cappedBuffer
+			var respBody io.Reader = resp.Body
+			if record.Enabled {
+				respBody = io.TeeReader(resp.Body, &captured)
+			}
+			_, err = io.Copy(w, respBody)
+			response = captured.Bytes()
+			upstreamTime = time.Since(upstreamStart)
+		}
 		if err != nil {
 			logError(w, r, "Could not write proxied response", err)
 			return
 		}
-		done := time.Now().Sub(start)
-		fmt.Printf("%v\t%v\tStatus %v\t%.2fs\n", id, path, resp.StatusCode, float64(done)/float64(time.Second))
-
-		// Let the docker job know that this battle snake has just been used
-		go func() {
-			docker.UpdateUsed(id)
-		}()
+		finish(resp.StatusCode, response, false)
 	}
 }
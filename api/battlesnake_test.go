@@ -0,0 +1,184 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/battlesnake-manager/docker"
+)
+
+const benchRepo string = "bench/snake"
+
+var benchMoveBody []byte = []byte(`{"game":{"id":"bench-game","ruleset":{"name":"standard"},"timeout":500},"turn":12,` +
+	`"board":{"height":11,"width":11,"food":[{"x":3,"y":3}],"hazards":[],` +
+	`"snakes":[{"id":"you","name":"you","health":90,"body":[{"x":5,"y":5},{"x":5,"y":4},{"x":5,"y":3}],"head":{"x":5,"y":5},"length":3}]},` +
+	`"you":{"id":"you","name":"you","health":90,"body":[{"x":5,"y":5},{"x":5,"y":4},{"x":5,"y":3}],"head":{"x":5,"y":5},"length":3}}`)
+
+// Start a snake on localhost and a fake Engine API that reports it as a
+// running container, then wait for the manager's state snapshot to mark it
+// ready. Returns the container name and the snake's address.
+func startBenchSnake(b testing.TB) (string, string) {
+	return startFakeSnake(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"move":"up"}`)
+	}))
+}
+
+func startFakeSnake(b testing.TB, handler http.Handler) (string, string) {
+	b.Helper()
+	// Every proxied request is logged, which would dominate the results
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() {
+		slog.SetDefault(logger)
+	})
+
+	snake := httptest.NewServer(handler)
+	b.Cleanup(snake.Close)
+	addr := strings.TrimPrefix(snake.URL, "http://")
+	_, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+
+	socket := filepath.Join(b.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		b.Fatal(err)
+	}
+	engine := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"State":{"Running":true,"Paused":false},"NetworkSettings":{"Networks":{"bridge":{"IPAddress":"127.0.0.1"}}}}`)
+	}))
+	engine.Listener = listener
+	engine.Start()
+	b.Cleanup(engine.Close)
+	docker.SetSocketPath(socket)
+
+	name := docker.RepoNameToContainerName(benchRepo)
+	docker.RegisterContainer(benchRepo, docker.RunOptions{Port: portNumber})
+	b.Cleanup(func() {
+		docker.UnregisterContainer(benchRepo)
+		forgetUpstream(name)
+	})
+	if err := docker.EnsureContainerReady(context.Background(), name); err != nil {
+		b.Fatal(err)
+	}
+	if _, ok := docker.ReadyAddress(name); !ok {
+		b.Fatal("The snake is not ready")
+	}
+	return name, addr
+}
+
+func proxyMove(name string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	registerBattleSnakeRoutes(router)
+	req := httptest.NewRequest("POST", "/bs/"+strings.TrimPrefix(name, "bs-")+"/move", bytes.NewReader(benchMoveBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyMoveContentLength(t *testing.T) {
+	name, _ := startFakeSnake(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		// Sent in chunks, without a length
+		io.WriteString(w, `{"move":`)
+		w.(http.Flusher).Flush()
+		io.WriteString(w, `"up"}`)
+	}))
+
+	w := proxyMove(name)
+	if w.Code != 200 || w.Body.String() != `{"move":"up"}` {
+		t.Fatalf("status %v: %q", w.Code, w.Body.String())
+	}
+	if length := w.Header().Get("Content-Length"); length != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length = %q, body is %v bytes", length, w.Body.Len())
+	}
+	if encoding := w.Header().Get("Transfer-Encoding"); encoding != "" {
+		t.Errorf("Transfer-Encoding = %q", encoding)
+	}
+}
+
+func TestProxyMoveTooLarge(t *testing.T) {
+	name, _ := startFakeSnake(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"move":"left","shout":"`+strings.Repeat("a", maxRecordedResponse)+`"}`)
+	}))
+
+	w := proxyMove(name)
+	if w.Code != 200 || w.Body.Len() > 100 || strings.Contains(w.Body.String(), `"left"`) {
+		t.Fatalf("Expected a fallback move, got status %v: %.100q", w.Code, w.Body.String())
+	}
+}
+
+// The time the manager adds to a move is the difference between the proxied
+// and direct runs
+func BenchmarkProxyMove(b *testing.B) {
+	name, addr := startBenchSnake(b)
+
+	b.Run("direct", func(b *testing.B) {
+		client := getUpstream(name, addr).client
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp, err := client.Post("http://"+addr+snakeMovePath, "application/json", bytes.NewReader(benchMoveBody))
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+
+	b.Run("proxied", func(b *testing.B) {
+		router := mux.NewRouter()
+		registerBattleSnakeRoutes(router)
+		path := "/bs/" + strings.TrimPrefix(name, "bs-") + "/move"
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			req := httptest.NewRequest("POST", path, bytes.NewReader(benchMoveBody))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != 200 || !strings.Contains(w.Body.String(), `"up"`) {
+				b.Fatalf("status %v: %v", w.Code, w.Body.String())
+			}
+		}
+	})
+}
+
+func BenchmarkReadyAddress(b *testing.B) {
+	name, _ := startBenchSnake(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, ok := docker.ReadyAddress(name); !ok {
+				b.Fatal("The snake is not ready")
+			}
+		}
+	})
+}
+
+func BenchmarkGetUpstream(b *testing.B) {
+	name, addr := startBenchSnake(b)
+	getUpstream(name, addr)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			getUpstream(name, addr)
+		}
+	})
+}
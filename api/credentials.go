@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// How to authenticate when cloning a private repo. Either an ssh deploy key,
+// or an https token read from a file or environment variable.
+type Credential struct {
+	SSHKeyFile string `json:"ssh_key_file"`
+	TokenFile  string `json:"token_file"`
+	TokenEnv   string `json:"token_env"`
+	// The user the token is sent as, defaults to x-access-token
+	Username string `json:"username"`
+}
+
+func (c Credential) IsSet() bool {
+	return c.SSHKeyFile != "" || c.TokenFile != "" || c.TokenEnv != ""
+}
+
+func (c Credential) Validate() error {
+	sources := 0
+	for _, source := range []string{c.SSHKeyFile, c.TokenFile, c.TokenEnv} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("Only one of ssh_key_file, token_file and token_env may be set")
+	}
+	if c.Username != "" && c.SSHKeyFile != "" {
+		return errors.New("username only applies to tokens")
+	}
+	if c.SSHKeyFile != "" {
+		if _, err := os.Stat(c.SSHKeyFile); err != nil {
+			return fmt.Errorf("Could not find the ssh key: %w", err)
+		}
+	}
+	if c.TokenFile != "" || c.TokenEnv != "" {
+		if _, err := c.token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Credential) token() (string, error) {
+	if c.TokenFile != "" {
+		body, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("Could not read the token file: %w", err)
+		}
+		token := strings.TrimSpace(string(body))
+		if token == "" {
+			return "", fmt.Errorf("The token file %v is empty", c.TokenFile)
+		}
+		return token, nil
+	}
+	token := strings.TrimSpace(os.Getenv(c.TokenEnv))
+	if token == "" {
+		return "", fmt.Errorf("The environment variable %v is not set", c.TokenEnv)
+	}
+	return token, nil
+}
+
+// Convert an https clone url into the equivalent ssh one
+func sshCloneUrl(cloneUrl string) string {
+	parsed, err := url.Parse(cloneUrl)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		// Already an ssh url such as git@host:owner/repo.git
+		return cloneUrl
+	}
+	return "git@" + parsed.Hostname() + ":" + strings.TrimPrefix(parsed.Path, "/")
+}
+
+// Get the url to clone from and the extra environment git needs to
+// authenticate. The secret is only ever passed through the environment or a
+// private temporary file so it never shows up in process arguments, logs or
+// the cloned repo's config. cleanup must be called once git has finished.
+func (c Credential) cloneSetup(cloneUrl string) (string, []string, func(), error) {
+	cleanup := func() {}
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	if cloneUrl == "" {
+		return "", nil, cleanup, errors.New("No clone url is configured")
+	}
+
+	if c.SSHKeyFile != "" {
+		// ssh refuses keys that are readable by others, so use a private copy
+		key, err := os.ReadFile(c.SSHKeyFile)
+		if err != nil {
+			return "", nil, cleanup, fmt.Errorf("Could not read the ssh key: %w", err)
+		}
+		keyFile, err := os.CreateTemp("", "deploy-key-*")
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+		cleanup = func() {
+			os.Remove(keyFile.Name())
+		}
+		_, err = keyFile.Write(key)
+		if closeErr := keyFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, func() {}, err
+		}
+
+		env = append(env, fmt.Sprintf(
+			"GIT_SSH_COMMAND=ssh -i %v -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new -o UserKnownHostsFile=/data/known_hosts",
+			keyFile.Name(),
+		))
+		return sshCloneUrl(cloneUrl), env, cleanup, nil
+	}
+
+	if c.TokenFile != "" || c.TokenEnv != "" {
+		parsed, err := url.Parse(cloneUrl)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+			return "", nil, cleanup, errors.New("Tokens can only be used with http(s) clone urls")
+		}
+		token, err := c.token()
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+		username := c.Username
+		if username == "" {
+			username = "x-access-token"
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + token))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http."+parsed.Scheme+"://"+parsed.Host+"/.extraheader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+	return cloneUrl, env, cleanup, nil
+}
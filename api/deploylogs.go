@@ -0,0 +1,206 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/battlesnake-manager/docker"
+)
+
+// Where the output of each deploy is written, as <snake>/<id>.log
+const deployLogDir string = "/data/deploys"
+
+// The largest a deploy log may grow, output past it is dropped
+const maxDeployLogSize int64 = 10 << 20
+
+// How many deploy logs are kept for each snake
+const maxDeployLogs int = 20
+
+// The key that public links to deploy logs are signed with. It is kept next
+// to the logs so that links stay valid when the manager restarts.
+const deployLinkKeyPath string = deployLogDir + "/.link-key"
+
+var deployLinkKey []byte
+var deployLinkKeyOnce sync.Once
+
+var deployIdPattern *regexp.Regexp = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}-[0-9a-f]{8}$`)
+
+// The log directory of a snake, named like the snake's id in the admin api
+func deployLogSnakeDir(repoName string) string {
+	id := strings.TrimPrefix(docker.RepoNameToContainerName(repoName), "bs-")
+	return filepath.Join(deployLogDir, id)
+}
+
+func deployLogPath(repoName string, deployId string) string {
+	return filepath.Join(deployLogSnakeDir(repoName), deployId+".log")
+}
+
+// Create the log file of a deploy, removing the snake's oldest logs
+func createDeployLog(repoName string, deployId string) (*os.File, error) {
+	dir := deployLogSnakeDir(repoName)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(deployLogPath(repoName, deployId), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	pruneDeployLogs(dir)
+	return f, nil
+}
+
+// Remove all but the newest deploy logs in dir. Deploy ids start with their
+// time, so sorting by name sorts them by age.
+func pruneDeployLogs(dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return
+	}
+	sort.Strings(paths)
+	for len(paths) > maxDeployLogs {
+		if err := os.Remove(paths[0]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Could not remove old deploy log", "path", paths[0], "error", err)
+		}
+		paths = paths[1:]
+	}
+}
+
+// Find the log of a deploy whose snake is not known. Returns an empty string
+// if there is none.
+func findDeployLog(deployId string) string {
+	if !deployIdPattern.MatchString(deployId) {
+		return ""
+	}
+	paths, _ := filepath.Glob(filepath.Join(deployLogDir, "*", deployId+".log"))
+	if len(paths) == 0 {
+		return ""
+	}
+	return paths[0]
+}
+
+// Write the log of a deploy. If the deploy is still running and `follow` is
+// not false, the response stays open and streams new output until the deploy
+// finishes.
+func serveDeployLog(w http.ResponseWriter, r *http.Request, repoName string, deployId string) {
+	if !deployIdPattern.MatchString(deployId) {
+		writeJsonError(w, 404, "Deploy log not found")
+		return
+	}
+	path := deployLogPath(repoName, deployId)
+	job := getJob(deployId)
+	if job == nil || job.info.Snake != repoName {
+		if _, err := os.Stat(path); err != nil {
+			writeJsonError(w, 404, "Deploy log not found")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, path)
+		return
+	}
+	follow := r.URL.Query().Get("follow") != "false"
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	var offset int64
+	for {
+		size, changed, closed := job.logState()
+		if size > offset {
+			if f == nil {
+				var err error
+				if f, err = os.Open(path); err != nil {
+					slog.ErrorContext(r.Context(), "Could not open deploy log", "path", path, "error", err)
+					return
+				}
+			}
+			n, err := io.CopyN(w, f, size-offset)
+			offset += n
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if closed || !follow {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func adminDeployLog(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	state, err := docker.GetState(id)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	serveDeployLog(w, r, state.RepoName, mux.Vars(r)["deploy"])
+}
+
+func linkKey() []byte {
+	deployLinkKeyOnce.Do(func() {
+		key, err := os.ReadFile(deployLinkKeyPath)
+		if err == nil && len(key) >= 32 {
+			deployLinkKey = key
+			return
+		}
+		key = make([]byte, 32)
+		rand.Read(key)
+		deployLinkKey = key
+		err = os.MkdirAll(deployLogDir, 0o750)
+		if err == nil {
+			err = os.WriteFile(deployLinkKeyPath, key, 0o600)
+		}
+		if err != nil {
+			slog.Warn("Could not save the deploy log link key, links will stop working when the manager restarts", "error", err)
+		}
+	})
+	return deployLinkKey
+}
+
+// The signature that lets anyone with a link read a deploy's log
+func signDeployLink(deployId string) string {
+	hasher := hmac.New(sha256.New, linkKey())
+	hasher.Write([]byte(deployId))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Serve the log of a deploy to anyone holding a signed link. These links are
+// posted to commit statuses and notifications where the admin token is not
+// available.
+func publicDeployLog(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["deploy"]
+	sig, err := hex.DecodeString(r.URL.Query().Get("sig"))
+	expected, _ := hex.DecodeString(signDeployLink(id))
+	if err != nil || !hmac.Equal(sig, expected) {
+		w.WriteHeader(404)
+		w.Write([]byte("404 Deploy Log Not Found"))
+		return
+	}
+	serveJobLog(w, r, id)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type genericPushRequest struct {
+	Repository    string `json:"repository"`
+	Ref           string `json:"ref"`
+	After         string `json:"after"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+// A minimal webhook for git hosts without a dedicated provider, or for
+// scripts. The payload is
+//
+//	{"repository": "owner/repo", "ref": "refs/heads/main", "after": "<sha>"}
+//
+// signed like GitHub's in an X-Signature-256 header. An optional
+// X-Delivery-ID header protects against replays.
+type genericProvider struct{}
+
+func (genericProvider) Name() string {
+	return "generic"
+}
+
+func (genericProvider) Detect(r *http.Request) bool {
+	return r.Header.Get("X-Signature-256") != ""
+}
+
+func (genericProvider) Event(r *http.Request) string {
+	return eventPush
+}
+
+func (genericProvider) Delivery(r *http.Request) string {
+	return r.Header.Get("X-Delivery-ID")
+}
+
+func (genericProvider) Verify(r *http.Request, body []byte, secret []byte) error {
+	return checkSecret(body, secret, r.Header.Get("X-Signature-256"))
+}
+
+func (genericProvider) ParsePush(body []byte) (pushEvent, error) {
+	var request genericPushRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return pushEvent{}, err
+	}
+	return pushEvent{
+		Repo:          request.Repository,
+		Ref:           request.Ref,
+		After:         request.After,
+		Deleted:       isNullCommit(request.After),
+		Private:       false,
+		DefaultBranch: request.DefaultBranch,
+	}, nil
+}
+
+func (genericProvider) DefaultCloneUrl(repoName string) string {
+	return ""
+}
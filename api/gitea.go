@@ -0,0 +1,90 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type giteaPushRequest struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Repository struct {
+		FullName      string `json:"full_name"`
+		Private       bool   `json:"private"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+}
+
+// Gitea and its fork Forgejo send the same payloads, only the header names
+// differ
+type giteaProvider struct {
+	name string
+}
+
+func (p giteaProvider) header(suffix string) string {
+	if p.name == "forgejo" {
+		return "X-Forgejo-" + suffix
+	}
+	return "X-Gitea-" + suffix
+}
+
+func (p giteaProvider) Name() string {
+	return p.name
+}
+
+func (p giteaProvider) Detect(r *http.Request) bool {
+	return r.Header.Get(p.header("Event")) != ""
+}
+
+func (p giteaProvider) Event(r *http.Request) string {
+	if r.Header.Get(p.header("Event")) == "push" {
+		return eventPush
+	}
+	return eventOther
+}
+
+func (p giteaProvider) Delivery(r *http.Request) string {
+	return r.Header.Get(p.header("Delivery"))
+}
+
+func (p giteaProvider) Verify(r *http.Request, body []byte, secret []byte) error {
+	sig := strings.TrimPrefix(r.Header.Get(p.header("Signature")), "sha256=")
+	if sig == "" {
+		return errors.New("Bad Signature")
+	}
+	sum, err := hex.DecodeString(sig)
+	if err != nil {
+		return err
+	}
+	hasher := hmac.New(sha256.New, secret)
+	hasher.Write(body)
+	if !hmac.Equal(hasher.Sum(nil), sum) {
+		return errors.New("Signature invalid")
+	}
+	return nil
+}
+
+func (giteaProvider) ParsePush(body []byte) (pushEvent, error) {
+	var request giteaPushRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return pushEvent{}, err
+	}
+	return pushEvent{
+		Repo:          request.Repository.FullName,
+		Ref:           request.Ref,
+		After:         request.After,
+		Deleted:       isNullCommit(request.After),
+		Private:       request.Repository.Private,
+		DefaultBranch: request.Repository.DefaultBranch,
+	}, nil
+}
+
+// Gitea is always self hosted, so the clone url has to be configured
+func (giteaProvider) DefaultCloneUrl(repoName string) string {
+	return ""
+}
@@ -1,8 +1,9 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
@@ -11,36 +12,92 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
-	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/games"
+	"github.com/ttocsneb/battlesnake-manager/notify"
+	"github.com/ttocsneb/battlesnake-manager/store"
 )
 
+// The per-repo settings from the config file
+type RepoSettings struct {
+	Secret string
+	Deploy DeployRule
+	// How many images to keep around for rollbacks
+	KeepImages int
+	// How to authenticate when cloning a private repo
+	Credential Credential
+	// Which git host sends the repo's webhooks, github if empty
+	Provider string
+	// Where the repo is cloned from, the provider's default if empty
+	CloneUrl string
+	// How to report deploys as commit statuses
+	Status StatusSettings
+	// Whether to record the snake's games
+	Record games.Settings
+	// Whether to replay recorded games against new builds
+	Replay ReplaySettings
+}
+
+func (s RepoSettings) cloneUrl(repoName string) string {
+	if s.CloneUrl != "" {
+		return s.CloneUrl
+	}
+	if provider := getWebhookProvider(s.Provider); provider != nil {
+		return provider.DefaultCloneUrl(repoName)
+	}
+	return ""
+}
+
 type buildConfigT struct {
-	Secret        []byte
+	Settings atomic.Pointer[RepoSettings]
+	// Held while a deploy or rollback of the repo is running
 	BuildingMutex sync.Mutex
-	Queued        bool
 }
 
 var buildConfig map[string]*buildConfigT = map[string]*buildConfigT{}
+var buildConfigMutex sync.RWMutex
 
-func RegisterSecret(repoName string, secret string) {
-	buildConfig[repoName] = &buildConfigT{
-		Secret:        []byte(secret),
-		BuildingMutex: sync.Mutex{},
-		Queued:        false,
-	}
+func getBuildConfig(repoName string) *buildConfigT {
+	buildConfigMutex.RLock()
+	defer buildConfigMutex.RUnlock()
 
+	return buildConfig[repoName]
 }
 
-func registerGithubHandlers(r *mux.Router) {
-	r.HandleFunc("/deploy/", githubWebhookHandler)
+func (c *buildConfigT) settings() RepoSettings {
+	return *c.Settings.Load()
+}
+
+// Register the settings for a repo. If the repo is already registered, the
+// settings are swapped in place so that in-flight deploys are unaffected.
+func RegisterRepo(repoName string, settings RepoSettings) {
+	buildConfigMutex.Lock()
+	defer buildConfigMutex.Unlock()
+
+	conf, found := buildConfig[repoName]
+	if !found {
+		conf = &buildConfigT{}
+		buildConfig[repoName] = conf
+	}
+	conf.Settings.Store(&settings)
+}
+
+func UnregisterRepo(repoName string) {
+	buildConfigMutex.Lock()
+	delete(buildConfig, repoName)
+	buildConfigMutex.Unlock()
+
+	cancelSnakeJobs(repoName)
+	forgetUpstream(docker.RepoNameToContainerName(repoName))
 }
 
 func checkSecret(payload []byte, secret []byte, sig string) error {
@@ -73,299 +130,244 @@ func checkSecret(payload []byte, secret []byte, sig string) error {
 	return nil
 }
 
-type repository struct {
+type githubRepository struct {
 	Private       bool   `json:"private"`
 	FullName      string `json:"full_name"`
 	DefaultBranch string `json:"default_branch"`
 }
 
-type pushRequest struct {
-	Ref        string     `json:"ref"`
-	Repository repository `json:"repository"`
+type githubPushRequest struct {
+	Ref        string           `json:"ref"`
+	After      string           `json:"after"`
+	Deleted    bool             `json:"deleted"`
+	Repository githubRepository `json:"repository"`
 }
 
-func githubWebhookHandler(w http.ResponseWriter, r *http.Request) {
-	event := r.Header.Get("X-GitHub-Event")
-	sig := r.Header.Get("X-Hub-Signature")
-	sig256 := r.Header.Get("X-Hub-Signature-256")
-	contentType := r.Header.Get("Content-Type")
-
-	agent := r.Header.Get("User-Agent")
+type githubProvider struct{}
 
-	if !strings.HasPrefix(agent, "GitHub-Hookshot/") {
-		w.WriteHeader(401)
-		w.Write([]byte("Access Denied"))
-		return
-	}
-
-	if contentType != "application/json" {
-		w.WriteHeader(400)
-		w.Write([]byte("Invalid Content-Type. Only json Supported"))
-		return
-	}
+func (githubProvider) Name() string {
+	return "github"
+}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(400)
-		w.Write([]byte("Invalid Request"))
-		return
-	}
+func (githubProvider) Detect(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("User-Agent"), "GitHub-Hookshot/")
+}
 
-	var request pushRequest
-	err = json.Unmarshal(body, &request)
-	if err != nil {
-		w.WriteHeader(400)
-		w.Write([]byte("Invalid Request"))
-		return
+func (githubProvider) Event(r *http.Request) string {
+	switch r.Header.Get("X-GitHub-Event") {
+	case "push":
+		return eventPush
+	case "ping":
+		return eventPing
 	}
+	return eventOther
+}
 
-	repoName := request.Repository.FullName
+func (githubProvider) Delivery(r *http.Request) string {
+	return r.Header.Get("X-GitHub-Delivery")
+}
 
-	if sig256 != "" {
+func (githubProvider) Verify(r *http.Request, body []byte, secret []byte) error {
+	sig := r.Header.Get("X-Hub-Signature")
+	if sig256 := r.Header.Get("X-Hub-Signature-256"); sig256 != "" {
 		sig = sig256
 	}
-	conf, found := buildConfig[repoName]
-	if !found {
-		w.WriteHeader(401)
-		w.Write([]byte("Access Denied: "))
-		w.Write([]byte("Not registered"))
-		return
-	}
-
-	if err = checkSecret(body, conf.Secret, sig); err != nil {
-		w.WriteHeader(401)
-		w.Write([]byte("Access Denied: "))
-		w.Write([]byte(err.Error()))
-		return
-	}
-
-	if event == "ping" {
-		w.WriteHeader(200)
-		w.Write([]byte("pong"))
-		return
-	}
+	return checkSecret(body, secret, sig)
+}
 
-	if event != "push" {
-		w.WriteHeader(403)
-		w.Write([]byte("Action Forbidden"))
-		return
-	}
+func (githubProvider) ParsePush(body []byte) (pushEvent, error) {
+	var request githubPushRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return pushEvent{}, err
+	}
+	return pushEvent{
+		Repo:          request.Repository.FullName,
+		Ref:           request.Ref,
+		After:         request.After,
+		Deleted:       request.Deleted,
+		Private:       request.Repository.Private,
+		DefaultBranch: request.Repository.DefaultBranch,
+	}, nil
+}
 
-	if request.Repository.Private {
-		w.WriteHeader(500)
-		w.Write([]byte("Cannot Access Private Repos"))
-		return
-	}
+func (githubProvider) DefaultCloneUrl(repoName string) string {
+	return "https://github.com/" + repoName + ".git"
+}
 
-	ref := strings.Split(request.Ref, "/")
-	if len(ref) != 3 || ref[0] != "refs" {
-		w.WriteHeader(200)
-		w.Write([]byte("Ignoring push to "))
-		w.Write([]byte(request.Ref))
-		w.Write([]byte("\nOnly deploying from branch "))
-		w.Write([]byte(request.Repository.DefaultBranch))
-		return
-	}
-	if ref[1] == "tags" {
-		w.WriteHeader(200)
-		w.Write([]byte("Ignoring push to tag "))
-		w.Write([]byte(ref[2]))
-		w.Write([]byte("\nOnly deploying from branch "))
-		w.Write([]byte(request.Repository.DefaultBranch))
-		return
-	}
-	if ref[1] != "heads" {
-		w.WriteHeader(200)
-		w.Write([]byte("Ignoring push to "))
-		w.Write([]byte(request.Ref))
-		w.Write([]byte("\nOnly deploying from branch "))
-		w.Write([]byte(request.Repository.DefaultBranch))
-		return
-	}
-	if ref[2] != request.Repository.DefaultBranch {
-		w.WriteHeader(200)
-		w.Write([]byte("Ignoring push to branch "))
-		w.Write([]byte(ref[2]))
-		w.Write([]byte("\nOnly deploying from branch "))
-		w.Write([]byte(request.Repository.DefaultBranch))
-		return
-	}
+func newDeployId() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
 
-	locked := conf.BuildingMutex.TryLock()
-	if !locked {
-		w.WriteHeader(200)
-		w.Write([]byte("There is already a job deploying\n"))
-		w.Write([]byte("Adding the build job to the queue"))
-		conf.Queued = true
-		return
+// Find the commit a branch, tag or commit refers to in a fresh clone
+func resolveRef(ctx context.Context, repoDir string, ref string) (string, error) {
+	for _, candidate := range []string{"origin/" + ref, ref} {
+		out, err := exec.CommandContext(ctx, "git", "-C", repoDir, "rev-parse", "--verify", "--quiet", candidate+"^{commit}").Output()
+		if err == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
 	}
-
-	go deployApplication(request.Repository.FullName)
-
-	w.WriteHeader(200)
-	w.Write([]byte("Deploying "))
-	w.Write([]byte(request.Repository.FullName))
-	w.Write([]byte("..."))
+	return "", fmt.Errorf("%v is not a branch, tag or commit", ref)
 }
 
+// Queue the first deploy of a snake whose container does not exist yet
 func DeployApplicationPublic(repoName string) {
-	conf := buildConfig[repoName]
-	if conf == nil {
-		fmt.Println("Could not deploy container, not registered")
-		return
+	if _, err := enqueueDeploy(repoName, "", triggerInitial); err != nil {
+		slog.Error("Could not deploy container", "snake", repoName, "error", err)
 	}
-	conf.BuildingMutex.Lock()
-
-	deployApplication(repoName)
 }
 
-func deployApplication(repoName string) {
+// Build and deploy a job's ref. The build output is written to the job's
+// log. Cancelling ctx stops the deploy.
+func deployApplication(ctx context.Context, conf *buildConfigT, job *deployJob) error {
+	repoName := job.info.Snake
+	ref := job.info.Ref
 	containerName := docker.RepoNameToContainerName(repoName)
-	fmt.Printf("Deploying container %v...\n", containerName)
-
-	conf := buildConfig[repoName]
-	if conf == nil {
-		fmt.Println("Could not deploy container, not registered")
-		return
-	}
-	defer func() {
-		// When this function finishes, If there was another job queued, re-run
-		// the job, otherwise free the mutex
-		if conf.Queued {
-			conf.Queued = false
-			deployApplication(repoName)
-		} else {
-			conf.BuildingMutex.Unlock()
-		}
-	}()
-
+	settings := conf.settings()
+	slog.InfoContext(ctx, "Deploying container", "container", containerName, "ref", ref, "trigger", job.info.Trigger)
+	notify.Send(ctx, notify.Event{
+		Event:    notify.EventDeployStarted,
+		Snake:    repoName,
+		DeployID: job.info.ID,
+		Ref:      ref,
+		Url:      deployLogUrl(job.info.ID),
+	})
+
+	// Record the first error, further errors are only logged
+	var deployErr error
 	errorLogger := func(msg string, err error) {
-		fmt.Printf("While deploying %v\n", repoName)
-		fmt.Printf("\t%v:\n", msg)
-		fmt.Printf("\t%v\n", err)
+		slog.ErrorContext(ctx, msg, "error", err)
+		if deployErr == nil {
+			deployErr = fmt.Errorf("%v: %w", msg, err)
+		}
 	}
-	runCmd := func(message string, name string, args ...string) bool {
-		cmd := exec.Command(name, args...)
-		cmd.Env = append(cmd.Env, "DOCKER_HOST=unix:///var/run/docker.sock")
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		err := cmd.Start()
-		if err != nil {
-			errorLogger(message, err)
-			return false
+	runCmd := func(message string, env []string, name string, args ...string) bool {
+		cmd := exec.CommandContext(ctx, name, args...)
+		if env != nil {
+			cmd.Env = append(os.Environ(), env...)
 		}
-		err = cmd.Wait()
-		if err != nil {
+		cmd.Stderr = job
+		cmd.Stdout = job
+		if err := cmd.Run(); err != nil {
 			errorLogger(message, err)
 			return false
 		}
 		return true
 	}
 
-	exists := true
 	_, err := docker.CheckContainer(containerName)
-	if err != nil {
-		if err == docker.ErrorDoesNotExist {
-			exists = false
-		} else {
-			errorLogger("Could not get container state", err)
-			return
-		}
-	}
-
-	cmd := exec.Command("docker", "images", "--format", "{{ json . }}", repoName)
-	cmd.Env = append(cmd.Env, "DOCKER_HOST=unix:///var/run/docker.sock")
-	cmd.Stderr = os.Stderr
-	reader, err := cmd.StdoutPipe()
-	if err != nil {
-		errorLogger("Could not create stdout pipe", err)
-		return
-	}
-	err = cmd.Start()
-	if err != nil {
-		errorLogger("Could not get list of container images", err)
-		return
-	}
-	imagesRaw, err := io.ReadAll(reader)
-	if err != nil {
-		errorLogger("Could not get list of container images", err)
-		return
-	}
-	imageErr := cmd.Wait()
-	if imageErr != nil {
-		errorLogger("Could not get list of container images", err)
+	if err != nil && err != docker.ErrorDoesNotExist {
+		errorLogger("Could not get container state", err)
+		return deployErr
 	}
 
 	repoDir, err := os.MkdirTemp("", containerName+"-*")
 	if err != nil {
 		errorLogger("Could not create tempdir", err)
-		return
+		return deployErr
 	}
 	defer func() {
 		if err := os.RemoveAll(repoDir); err != nil {
-			errorLogger(fmt.Sprintf("Could not cleanup %v", repoDir), err)
+			slog.ErrorContext(ctx, fmt.Sprintf("Could not cleanup %v", repoDir), "error", err)
 		}
 	}()
 
-	if !runCmd("Could not clone repo", "git", "clone", "https://github.com/"+repoName+".git", repoDir) {
-		return
+	cloneUrl, cloneEnv, cleanupCredential, err := settings.Credential.cloneSetup(settings.cloneUrl(repoName))
+	if err != nil {
+		errorLogger("Could not prepare the credential", err)
+		return deployErr
 	}
-	tag := repoName + ":local"
-	if !runCmd("Could not build image", "docker", "build", "-t", tag, repoDir) {
-		return
+	job.logLine("Cloning " + settings.cloneUrl(repoName))
+	cloned := runCmd("Could not clone repo", cloneEnv, "git", "clone", cloneUrl, repoDir)
+	cleanupCredential()
+	if !cloned {
+		return deployErr
 	}
-
-	if exists {
-		err = docker.StopContainer(containerName)
+	if ref == "" {
+		ref, err = settings.Deploy.resolveDefault(repoDir)
 		if err != nil {
-			errorLogger("Could not stop container", err)
-			return
-		}
-
-		if !runCmd("Could not delete container", "docker", "rm", containerName) {
-			return
+			errorLogger("Could not find what to deploy", err)
+			return deployErr
 		}
 	}
-	if !runCmd("Could not create container", "docker", "run", "-d", "--name", containerName, tag) {
-		return
+	if ref != "" {
+		sha, err := resolveRef(ctx, repoDir, ref)
+		if err != nil {
+			errorLogger("Could not find "+ref, err)
+			return deployErr
+		}
+		job.logLine("Checking out " + ref)
+		if !runCmd("Could not checkout "+ref, nil, "git", "-C", repoDir, "checkout", "--detach", sha) {
+			return deployErr
+		}
 	}
-
-	// Update the state machine
-	_, err = docker.CheckContainer(containerName)
+	commit, err := exec.CommandContext(ctx, "git", "-C", repoDir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		errorLogger("Could not get the cloned commit", err)
+		return deployErr
+	}
+	sha := strings.TrimSpace(string(commit))
+	job.setCommit(sha)
+	store.UpdateDeploy(containerName, job.info.ID, func(deploy *store.Deploy) {
+		deploy.Commit = sha
+	})
+	postCommitStatus(ctx, settings.Status, repoName, sha, statusPending, "Deploying", job.info.ID)
+	slog.InfoContext(ctx, "Building image", "commit", sha)
+	job.logLine("Building image for " + sha)
+
+	tag := docker.RepoNameToCommitImage(repoName, sha)
+	imageId, err := docker.BuildImage(ctx, repoDir, []string{tag}, job)
 	if err != nil {
-		if err == docker.ErrorDoesNotExist {
-			errorLogger("The container was not created", err)
-			return
+		errorLogger("Could not build image", err)
+		return deployErr
+	}
+	store.UpdateDeploy(containerName, job.info.ID, func(deploy *store.Deploy) {
+		deploy.ImageID = imageId
+	})
+
+	if settings.Replay.Enabled {
+		job.logLine("Replaying recorded games")
+		report, err := replayImage(ctx, repoName, imageId, nil, settings.Replay.games())
+		switch {
+		case err == ErrorNoGames:
+			job.logLine(err.Error())
+		case err != nil && settings.Replay.Block:
+			errorLogger("Could not replay games", err)
+			return deployErr
+		case err != nil:
+			slog.ErrorContext(ctx, "Could not replay games", "error", err)
+			job.logLine("Could not replay games: " + err.Error())
+		default:
+			io.WriteString(job, report.summary())
+			slog.InfoContext(ctx, "Replayed recorded games", "turns", report.Turns, "changed", report.Changed, "regressions", report.Regressions)
+			if settings.Replay.Block && report.Regressions > 0 {
+				errorLogger("The new build failed the replay", fmt.Errorf("%v moves became illegal or fatal", report.Regressions))
+				return deployErr
+			}
 		}
-		errorLogger("Could not get the container state", err)
-		return
 	}
 
-	fmt.Printf("Successfully deployed %v\n", containerName)
-	fmt.Println("Cleaning up old images...")
-
-	type imageInfo struct {
-		Id string `json:"ID"`
+	job.logLine("Replacing the container")
+	err = docker.SwapContainer(ctx, containerName, tag, job)
+	if err != nil {
+		errorLogger("Could not replace the container", err)
+		return deployErr
 	}
-	seenIds := []string{}
-	for _, image := range bytes.Split(imagesRaw, []byte("\n")) {
-		var img imageInfo
-		err := json.Unmarshal(image, &img)
-		if err != nil {
-			errorLogger("Could not parse image output", err)
-			continue
-		}
-
-		// Just in case there are multiple tags
-		if slices.Contains(seenIds, img.Id) {
-			continue
-		}
-		seenIds = append(seenIds, img.Id)
-
-		if !runCmd("Could not remove old image "+img.Id, "docker", "rmi", img.Id) {
-			continue
-		}
+	// Only mark the image as current once it is known to work
+	err = docker.TagImage(imageId, docker.RepoNameToImage(repoName))
+	if err != nil {
+		errorLogger("Could not tag the image", err)
+		return deployErr
 	}
 
-	fmt.Println("Finished Cleaning up old images")
+	slog.InfoContext(ctx, "Successfully deployed", "container", containerName, "image_id", imageId)
+	slog.InfoContext(ctx, "Cleaning up old images")
+	keep := settings.KeepImages
+	if keep <= 0 {
+		keep = defaultKeepImages
+	}
+	pruneImages(ctx, repoName, keep)
+	slog.InfoContext(ctx, "Finished cleaning up old images")
+	return nil
 }
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type gitlabPushRequest struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSha string `json:"checkout_sha"`
+	Project     struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		DefaultBranch     string `json:"default_branch"`
+		VisibilityLevel   int    `json:"visibility_level"`
+	} `json:"project"`
+}
+
+// GitLab only sends the secret token back as a header, it does not sign the
+// payload
+type gitlabProvider struct{}
+
+func (gitlabProvider) Name() string {
+	return "gitlab"
+}
+
+func (gitlabProvider) Detect(r *http.Request) bool {
+	return r.Header.Get("X-Gitlab-Event") != ""
+}
+
+func (gitlabProvider) Event(r *http.Request) string {
+	switch r.Header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+		return eventPush
+	}
+	return eventOther
+}
+
+func (gitlabProvider) Delivery(r *http.Request) string {
+	return r.Header.Get("X-Gitlab-Event-UUID")
+}
+
+func (gitlabProvider) Verify(r *http.Request, body []byte, secret []byte) error {
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		return errors.New("Bad Signature")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), secret) != 1 {
+		return errors.New("Signature invalid")
+	}
+	return nil
+}
+
+func (gitlabProvider) ParsePush(body []byte) (pushEvent, error) {
+	var request gitlabPushRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return pushEvent{}, err
+	}
+	return pushEvent{
+		Repo:          request.Project.PathWithNamespace,
+		Ref:           request.Ref,
+		After:         request.After,
+		Deleted:       isNullCommit(request.After),
+		Private:       request.Project.VisibilityLevel < 20,
+		DefaultBranch: request.Project.DefaultBranch,
+	}, nil
+}
+
+func (gitlabProvider) DefaultCloneUrl(repoName string) string {
+	return "https://gitlab.com/" + repoName + ".git"
+}
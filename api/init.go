@@ -1,26 +1,48 @@
 package api
 
 import (
-	"fmt"
+	"log/slog"
 	"net/http"
+	"regexp"
 
 	"github.com/gorilla/mux"
+	"github.com/ttocsneb/battlesnake-manager/logging"
+	"github.com/ttocsneb/battlesnake-manager/metrics"
 )
 
 func Serve() error {
 	r := mux.NewRouter()
+	r.Use(requestIdMiddleware)
 
 	registerBattleSnakeRoutes(r)
-	registerGithubHandlers(r)
+	registerWebhookHandlers(r)
+	registerAdminHandlers(r)
+	r.HandleFunc("/logs/{deploy}", publicDeployLog).Methods("GET")
+	r.Handle("/metrics", metrics.Handler())
 
-	fmt.Println("Starting server on port 80")
+	slog.Info("Starting server", "port", 80)
 	return http.ListenAndServe(":80", r)
 }
 
+var validRequestId *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Give every request an id that is attached to everything logged about it.
+// A well formed X-Request-ID header from the caller is reused.
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestId.MatchString(id) {
+			id = logging.NewID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := logging.With(r.Context(), "request_id", id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func logError(w http.ResponseWriter, r *http.Request, message string, err error) {
-	fmt.Printf("ERROR while processing %v\n", r.URL.Path)
-	fmt.Printf("\t%v\n", message)
-	fmt.Printf("\t%v\n", err)
+	slog.ErrorContext(r.Context(), message, "path", r.URL.Path, "error", err)
 
 	w.WriteHeader(500)
 	w.Write([]byte("500 Internal Server Error"))
@@ -30,3 +52,10 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(404)
 	w.Write([]byte("404 Battle-Snake Not Found"))
 }
+
+func notReady(w http.ResponseWriter, r *http.Request) {
+	slog.WarnContext(r.Context(), "Battle-Snake not ready in time", "path", r.URL.Path)
+
+	w.WriteHeader(503)
+	w.Write([]byte("503 Battle-Snake Not Ready"))
+}
@@ -0,0 +1,578 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/logging"
+	"github.com/ttocsneb/battlesnake-manager/notify"
+	"github.com/ttocsneb/battlesnake-manager/store"
+)
+
+// The states of a deploy job
+const (
+	jobQueued    = "queued"
+	jobRunning   = store.DeployRunning
+	jobSucceeded = store.DeploySucceeded
+	jobFailed    = store.DeployFailed
+	jobCancelled = store.DeployCancelled
+)
+
+// What a job does
+const (
+	jobDeploy = "deploy"
+	jobReplay = "replay"
+)
+
+// What started a deploy job
+const (
+	triggerPush    = "push"
+	triggerAdmin   = "admin"
+	triggerInitial = "initial"
+	triggerCli     = "cli"
+)
+
+// How many deploys may build at the same time when not configured
+const defaultConcurrentDeploys int = 1
+
+// How many finished jobs are kept in memory
+const maxFinishedJobs int = 100
+
+var ErrorJobNotFound = errors.New("Job not found")
+var ErrorJobFinished = errors.New("The job has already finished")
+
+type jobInfo struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Snake    string     `json:"snake"`
+	Trigger  string     `json:"trigger"`
+	Ref      string     `json:"ref,omitempty"`
+	Commit   string     `json:"commit,omitempty"`
+	Image    string     `json:"image,omitempty"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// A request to deploy a snake or to replay its games. The job's info is
+// guarded by jobsMutex, its log by its own mutex.
+type deployJob struct {
+	info   jobInfo
+	cancel context.CancelFunc
+
+	// The games a replay job replays, or how many recent ones
+	replayGameIds []string
+	replayCount   int
+
+	logMutex  sync.Mutex
+	logFile   *os.File
+	logSize   int64
+	truncated bool
+	closed    bool
+	// Closed and replaced whenever the log changes
+	changed chan struct{}
+}
+
+// All known jobs, oldest first
+var jobs []*deployJob
+var jobsMutex sync.Mutex
+var runningJobs int
+var maxConcurrentDeploys int = defaultConcurrentDeploys
+
+// Set how many deploys may build at the same time across all snakes. 0 uses
+// the default.
+func SetMaxConcurrentDeploys(limit int) {
+	if limit <= 0 {
+		limit = defaultConcurrentDeploys
+	}
+	jobsMutex.Lock()
+	maxConcurrentDeploys = limit
+	jobsMutex.Unlock()
+
+	scheduleJobs()
+}
+
+// Write build output to the job's log file. Output past the size cap is
+// dropped.
+func (j *deployJob) Write(p []byte) (int, error) {
+	j.logMutex.Lock()
+	defer j.logMutex.Unlock()
+
+	// Dropped output still counts as written so that commands do not fail
+	written := len(p)
+	if j.logFile == nil || j.closed || j.truncated {
+		return written, nil
+	}
+	if j.logSize+int64(len(p)) > maxDeployLogSize {
+		keep := int(maxDeployLogSize - j.logSize)
+		p = append(p[:keep:keep], "\n[output truncated]\n"...)
+		j.truncated = true
+	}
+	n, err := j.logFile.Write(p)
+	j.logSize += int64(n)
+	j.notifyUnsafe()
+	if err != nil {
+		slog.Error("Could not write to the deploy log", "job_id", j.info.ID, "error", err)
+		j.truncated = true
+	}
+	return written, nil
+}
+
+func (j *deployJob) notifyUnsafe() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Add a line to the job's log
+func (j *deployJob) logLine(line string) {
+	j.Write([]byte("==> " + line + "\n"))
+}
+
+// Create the job's log file
+func (j *deployJob) openLog() error {
+	f, err := createDeployLog(j.info.Snake, j.info.ID)
+	if err != nil {
+		return err
+	}
+	j.logMutex.Lock()
+	defer j.logMutex.Unlock()
+
+	j.logFile = f
+	j.notifyUnsafe()
+	return nil
+}
+
+// Get how much has been written to the log, a channel that is closed when
+// the log changes, and whether the job will not write any more
+func (j *deployJob) logState() (int64, <-chan struct{}, bool) {
+	j.logMutex.Lock()
+	defer j.logMutex.Unlock()
+
+	return j.logSize, j.changed, j.closed
+}
+
+func (j *deployJob) closeLog() {
+	j.logMutex.Lock()
+	defer j.logMutex.Unlock()
+
+	if j.closed {
+		return
+	}
+	j.closed = true
+	if j.logFile != nil {
+		if err := j.logFile.Close(); err != nil {
+			slog.Error("Could not close the deploy log", "job_id", j.info.ID, "error", err)
+		}
+	}
+	j.notifyUnsafe()
+}
+
+// Mark a job as finished. Must be called with jobsMutex held.
+func (j *deployJob) finishUnsafe(state string, err error) {
+	now := time.Now()
+	j.info.State = state
+	j.info.Finished = &now
+	if err != nil {
+		j.info.Error = err.Error()
+	}
+	j.closeLog()
+}
+
+func (j *deployJob) setCommit(commit string) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	j.info.Commit = commit
+}
+
+func (j *deployJob) commit() string {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	return j.info.Commit
+}
+
+func getJob(id string) *deployJob {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for _, job := range jobs {
+		if job.info.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// Queue a deploy of ref. An empty ref deploys what the repo's deploy rule
+// follows. Deploys of the same snake that are still waiting are superseded
+// by the new one.
+func enqueueDeploy(repoName string, ref string, trigger string) (jobInfo, error) {
+	if getBuildConfig(repoName) == nil {
+		return jobInfo{}, docker.ErrorNotRegistered
+	}
+
+	job := &deployJob{
+		info: jobInfo{
+			ID:      newDeployId(),
+			Kind:    jobDeploy,
+			Snake:   repoName,
+			Trigger: trigger,
+			Ref:     ref,
+			State:   jobQueued,
+			Created: time.Now(),
+		},
+		changed: make(chan struct{}),
+	}
+
+	jobsMutex.Lock()
+	for _, other := range jobs {
+		if other.info.Snake == repoName && other.info.Kind == jobDeploy && other.info.State == jobQueued {
+			other.finishUnsafe(jobCancelled, errors.New("Superseded by job "+job.info.ID))
+		}
+	}
+	jobs = append(jobs, job)
+	jobsMutex.Unlock()
+
+	slog.Info("Queued deploy job", "job_id", job.info.ID, "snake", repoName, "ref", ref, "trigger", trigger)
+	scheduleJobs()
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	return job.info, nil
+}
+
+// Queue a replay of recorded games against a temporary container created
+// from image. If gameIds is empty, the most recent count games are replayed.
+// Like deploys, only one job runs for each snake at a time.
+func enqueueReplay(repoName string, image string, commit string, gameIds []string, count int, trigger string) (jobInfo, error) {
+	if getBuildConfig(repoName) == nil {
+		return jobInfo{}, docker.ErrorNotRegistered
+	}
+
+	job := &deployJob{
+		info: jobInfo{
+			ID:      newDeployId(),
+			Kind:    jobReplay,
+			Snake:   repoName,
+			Trigger: trigger,
+			Commit:  commit,
+			Image:   image,
+			State:   jobQueued,
+			Created: time.Now(),
+		},
+		replayGameIds: gameIds,
+		replayCount:   count,
+		changed:       make(chan struct{}),
+	}
+
+	jobsMutex.Lock()
+	jobs = append(jobs, job)
+	jobsMutex.Unlock()
+
+	slog.Info("Queued replay job", "job_id", job.info.ID, "snake", repoName, "image", image, "trigger", trigger)
+	scheduleJobs()
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	return job.info, nil
+}
+
+// Start queued jobs, oldest first, while there is capacity. Only one job
+// runs for each snake at a time.
+func scheduleJobs() {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for _, job := range jobs {
+		if runningJobs >= maxConcurrentDeploys {
+			break
+		}
+		if job.info.State != jobQueued {
+			continue
+		}
+		conf := getBuildConfig(job.info.Snake)
+		if conf == nil {
+			job.finishUnsafe(jobCancelled, errors.New("The snake is no longer registered"))
+			continue
+		}
+		if !conf.BuildingMutex.TryLock() {
+			continue
+		}
+
+		runningJobs++
+		now := time.Now()
+		job.info.State = jobRunning
+		job.info.Started = &now
+		ctx := logging.With(context.Background(), "deploy_id", job.info.ID, "snake", job.info.Snake)
+		ctx, job.cancel = context.WithCancel(ctx)
+		go runJob(ctx, conf, job)
+	}
+	pruneJobsUnsafe()
+}
+
+// Forget the oldest finished jobs once there are too many
+func pruneJobsUnsafe() {
+	finished := 0
+	for _, job := range jobs {
+		if job.info.Finished != nil {
+			finished++
+		}
+	}
+	if finished <= maxFinishedJobs {
+		return
+	}
+	kept := jobs[:0]
+	for _, job := range jobs {
+		if job.info.Finished != nil && finished > maxFinishedJobs {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	clear(jobs[len(kept):])
+	jobs = kept
+}
+
+func runJob(ctx context.Context, conf *buildConfigT, job *deployJob) {
+	defer func() {
+		conf.BuildingMutex.Unlock()
+		jobsMutex.Lock()
+		runningJobs--
+		jobsMutex.Unlock()
+		scheduleJobs()
+	}()
+
+	var state string
+	var err error
+	if job.info.Kind == jobReplay {
+		state, err = runReplay(ctx, job)
+	} else {
+		state, err = runDeploy(ctx, conf, job)
+	}
+
+	jobsMutex.Lock()
+	job.finishUnsafe(state, err)
+	job.cancel()
+	jobsMutex.Unlock()
+}
+
+// Replay a snake's games, writing the report to the job's log
+func runReplay(ctx context.Context, job *deployJob) (string, error) {
+	if err := job.openLog(); err != nil {
+		slog.ErrorContext(ctx, "Could not create the replay log", "error", err)
+	}
+	job.logLine(fmt.Sprintf("Replay %v of %v against %v, triggered by %v", job.info.ID, job.info.Snake, job.info.Image, job.info.Trigger))
+
+	report, err := replayImage(ctx, job.info.Snake, job.info.Image, job.replayGameIds, job.replayCount)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = store.ErrorCancelled
+			job.logLine(err.Error())
+			return jobCancelled, err
+		}
+		job.logLine(err.Error())
+		return jobFailed, err
+	}
+	io.WriteString(job, report.summary())
+	job.logLine("Replayed successfully")
+	slog.InfoContext(ctx, "Replayed games", "turns", report.Turns, "changed", report.Changed, "regressions", report.Regressions)
+	return jobSucceeded, nil
+}
+
+// Build and deploy a snake, recording the deploy in its history and
+// reporting its outcome
+func runDeploy(ctx context.Context, conf *buildConfigT, job *deployJob) (string, error) {
+	repoName := job.info.Snake
+	containerName := docker.RepoNameToContainerName(repoName)
+	store.StartDeploy(containerName, job.info.ID)
+	store.UpdateDeploy(containerName, job.info.ID, func(deploy *store.Deploy) {
+		deploy.Trigger = job.info.Trigger
+	})
+
+	if err := job.openLog(); err != nil {
+		slog.ErrorContext(ctx, "Could not create the deploy log", "error", err)
+	}
+	job.logLine(fmt.Sprintf("Deploy %v of %v, triggered by %v", job.info.ID, repoName, job.info.Trigger))
+
+	start := time.Now()
+	err := deployApplication(ctx, conf, job)
+	state := jobSucceeded
+	if err != nil {
+		state = jobFailed
+		if ctx.Err() != nil {
+			state = jobCancelled
+			err = store.ErrorCancelled
+		}
+		job.logLine(err.Error())
+	} else {
+		job.logLine("Deployed successfully")
+	}
+	event := notify.Event{
+		Event:    notify.EventDeploySucceeded,
+		Snake:    repoName,
+		DeployID: job.info.ID,
+		Ref:      job.info.Ref,
+		Commit:   job.commit(),
+		Url:      deployLogUrl(job.info.ID),
+	}
+	if err != nil {
+		event.Event = notify.EventDeployFailed
+		event.Error = err.Error()
+	}
+	notify.Send(ctx, event)
+	switch state {
+	case jobSucceeded:
+		postCommitStatus(ctx, conf.settings().Status, repoName, job.commit(), statusSuccess, "Deployed", job.info.ID)
+	case jobCancelled:
+		postCommitStatus(ctx, conf.settings().Status, repoName, job.commit(), statusError, "The deploy was cancelled", job.info.ID)
+	default:
+		postCommitStatus(ctx, conf.settings().Status, repoName, job.commit(), statusFailure, err.Error(), job.info.ID)
+	}
+	deploysMetric.Inc(containerName, state)
+	deployDurationMetric.Observe(time.Since(start).Seconds(), containerName, state)
+	store.FinishDeploy(containerName, job.info.ID, err)
+	return state, err
+}
+
+// Cancel a job. A queued job is dropped, a running job is stopped.
+func cancelJob(id string) error {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for _, job := range jobs {
+		if job.info.ID != id {
+			continue
+		}
+		switch job.info.State {
+		case jobQueued:
+			job.finishUnsafe(jobCancelled, store.ErrorCancelled)
+		case jobRunning:
+			slog.Info("Cancelling deploy job", "job_id", id, "snake", job.info.Snake)
+			job.cancel()
+		default:
+			return ErrorJobFinished
+		}
+		return nil
+	}
+	return ErrorJobNotFound
+}
+
+// Cancel every job of a snake that is not finished
+func cancelSnakeJobs(repoName string) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for _, job := range jobs {
+		if job.info.Snake != repoName {
+			continue
+		}
+		switch job.info.State {
+		case jobQueued:
+			job.finishUnsafe(jobCancelled, store.ErrorCancelled)
+		case jobRunning:
+			job.cancel()
+		}
+	}
+}
+
+// List the jobs, newest first, optionally only those of one snake or in one
+// state
+func listJobs(repoName string, state string) []jobInfo {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	result := []jobInfo{}
+	for _, job := range jobs {
+		if repoName != "" && job.info.Snake != repoName {
+			continue
+		}
+		if state != "" && job.info.State != state {
+			continue
+		}
+		result = append(result, job.info)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Created.After(result[j].Created)
+	})
+	return result
+}
+
+func writeJobError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case ErrorJobNotFound:
+		writeJsonError(w, 404, err.Error())
+	case ErrorJobFinished:
+		writeJsonError(w, 409, err.Error())
+	default:
+		writeDockerError(w, r, err)
+	}
+}
+
+// List jobs. `snake` filters by snake id or name and `state` by state.
+func adminListJobs(w http.ResponseWriter, r *http.Request) {
+	snake := r.URL.Query().Get("snake")
+	if snake != "" && !strings.Contains(snake, "/") {
+		state, err := docker.GetState("bs-" + snake)
+		if err != nil {
+			writeDockerError(w, r, err)
+			return
+		}
+		snake = state.RepoName
+	}
+	writeJson(w, 200, listJobs(snake, r.URL.Query().Get("state")))
+}
+
+func adminGetJob(w http.ResponseWriter, r *http.Request) {
+	job := getJob(mux.Vars(r)["id"])
+	if job == nil {
+		writeJobError(w, r, ErrorJobNotFound)
+		return
+	}
+	jobsMutex.Lock()
+	info := job.info
+	jobsMutex.Unlock()
+	writeJson(w, 200, info)
+}
+
+func adminCancelJob(w http.ResponseWriter, r *http.Request) {
+	if err := cancelJob(mux.Vars(r)["id"]); err != nil {
+		writeJobError(w, r, err)
+		return
+	}
+	adminGetJob(w, r)
+}
+
+// Write a job's log, see serveDeployLog. The logs of jobs that are no longer
+// in memory are found on disk.
+func adminJobLog(w http.ResponseWriter, r *http.Request) {
+	serveJobLog(w, r, mux.Vars(r)["id"])
+}
+
+// Write the log of a job, which may have been dropped from memory already
+func serveJobLog(w http.ResponseWriter, r *http.Request, id string) {
+	if job := getJob(id); job != nil {
+		serveDeployLog(w, r, job.info.Snake, id)
+		return
+	}
+	path := findDeployLog(id)
+	if path == "" {
+		writeJobError(w, r, ErrorJobNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"github.com/ttocsneb/battlesnake-manager/metrics"
+)
+
+var proxyLatencyMetric *metrics.HistogramVec = metrics.NewHistogramVec(
+	"battlesnake_proxy_request_duration_seconds",
+	"Time taken to proxy a request to a snake, including any cold start",
+	[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	"snake", "endpoint",
+)
+
+var proxyOverheadMetric *metrics.HistogramVec = metrics.NewHistogramVec(
+	"battlesnake_proxy_overhead_seconds",
+	"Time the manager adds to a proxied request on top of waiting for the snake",
+	[]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1},
+	"snake", "endpoint",
+)
+
+var fallbackMovesMetric *metrics.CounterVec = metrics.NewCounterVec(
+	"battlesnake_fallback_moves_total",
+	"Number of moves the manager answered because the snake failed or was too slow",
+	"snake",
+)
+
+var deploysMetric *metrics.CounterVec = metrics.NewCounterVec(
+	"battlesnake_deploys_total",
+	"Number of finished deploys by outcome",
+	"snake", "outcome",
+)
+
+var deployDurationMetric *metrics.HistogramVec = metrics.NewHistogramVec(
+	"battlesnake_deploy_duration_seconds",
+	"Time taken by deploys by outcome",
+	[]float64{10, 30, 60, 120, 300, 600, 1200, 1800},
+	"snake", "outcome",
+)
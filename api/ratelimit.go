@@ -0,0 +1,124 @@
+package api
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// How many buckets a rate limiter holds before full ones are dropped
+const maxRateBuckets int = 10000
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A token bucket rate limiter for each key, such as a repo or an ip
+type rateLimiter struct {
+	// Tokens added per second
+	rate  float64
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// Take a token for key. If there is none, returns false and how long until
+// there will be one.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	bucket, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxRateBuckets {
+			l.pruneUnsafe(now)
+		}
+		bucket = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Forget the buckets that have filled up again
+func (l *rateLimiter) pruneUnsafe(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Remembers recently seen ids for a limited time, up to a maximum count
+type recentCache struct {
+	ttl time.Duration
+	max int
+
+	mutex sync.Mutex
+	seen  map[string]time.Time
+	// The ids in the order they were added
+	order []string
+}
+
+func newRecentCache(ttl time.Duration, max int) *recentCache {
+	return &recentCache{
+		ttl:  ttl,
+		max:  max,
+		seen: map[string]time.Time{},
+	}
+}
+
+// Record id, returning whether it was already seen
+func (c *recentCache) add(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if len(c.order) < c.max && now.Sub(c.seen[oldest]) < c.ttl {
+			break
+		}
+		delete(c.seen, oldest)
+		c.order = c.order[1:]
+	}
+
+	if _, found := c.seen[id]; found {
+		return true
+	}
+	c.seen[id] = now
+	c.order = append(c.order, id)
+	return false
+}
+
+// Forget id, so that it can be added again
+func (c *recentCache) remove(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.seen, id)
+	for i, other := range c.order {
+		if other == id {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			return
+		}
+	}
+}
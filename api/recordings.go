@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/games"
+)
+
+func adminListGames(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	if !docker.IsRegistered(id) {
+		writeDockerError(w, r, docker.ErrorNotRegistered)
+		return
+	}
+	recorded, err := games.List(id)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	writeJson(w, 200, recorded)
+}
+
+// Download a recorded game as gzipped json lines
+func adminDownloadGame(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	if !docker.IsRegistered(id) {
+		writeDockerError(w, r, docker.ErrorNotRegistered)
+		return
+	}
+	gameId := mux.Vars(r)["game"]
+	path, err := games.Path(id, gameId)
+	if err != nil {
+		writeJsonError(w, 404, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+gameId+`.jsonl.gz"`)
+	http.ServeFile(w, r, path)
+}
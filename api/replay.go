@@ -0,0 +1,320 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/games"
+	"github.com/ttocsneb/battlesnake-manager/rules"
+)
+
+// How many recent games are replayed when not configured
+const defaultReplayGames int = 10
+
+// How long a replayed move may take when the game has no timeout
+const defaultMoveTimeout time.Duration = 500 * time.Millisecond
+
+var ErrorNoGames = errors.New("There are no recorded games to replay")
+
+// Whether to replay recorded games against new builds before deploying them
+type ReplaySettings struct {
+	Enabled bool `json:"enabled"`
+	// How many of the most recent games to replay, 10 if not set
+	Games int `json:"games"`
+	// Fail the deploy if the new build makes illegal or fatal moves where the
+	// recorded games did not
+	Block bool `json:"block"`
+}
+
+func (s ReplaySettings) Validate() error {
+	if s.Games < 0 {
+		return errors.New("games must not be negative")
+	}
+	return nil
+}
+
+func (s ReplaySettings) games() int {
+	if s.Games <= 0 {
+		return defaultReplayGames
+	}
+	return s.Games
+}
+
+// A turn where the replayed move differs from the recorded one, or is bad
+type replayTurn struct {
+	Turn            int           `json:"turn"`
+	Recorded        string        `json:"recorded"`
+	Replayed        string        `json:"replayed"`
+	RecordedVerdict rules.Verdict `json:"recorded_verdict"`
+	Verdict         rules.Verdict `json:"verdict"`
+	// The replayed move is illegal or fatal while the recorded one was not
+	Regression bool    `json:"regression"`
+	LatencyMs  float64 `json:"latency_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type replayedGame struct {
+	ID          string       `json:"id"`
+	Turns       int          `json:"turns"`
+	Changed     int          `json:"changed"`
+	Illegal     int          `json:"illegal"`
+	Fatal       int          `json:"fatal"`
+	Regressions int          `json:"regressions"`
+	Errors      int          `json:"errors"`
+	Diffs       []replayTurn `json:"diffs"`
+	Error       string       `json:"error,omitempty"`
+}
+
+type replayReport struct {
+	Snake       string         `json:"snake"`
+	Image       string         `json:"image,omitempty"`
+	Turns       int            `json:"turns"`
+	Changed     int            `json:"changed"`
+	Illegal     int            `json:"illegal"`
+	Fatal       int            `json:"fatal"`
+	Regressions int            `json:"regressions"`
+	Errors      int            `json:"errors"`
+	Games       []replayedGame `json:"games"`
+}
+
+func (r *replayReport) add(game replayedGame) {
+	r.Turns += game.Turns
+	r.Changed += game.Changed
+	r.Illegal += game.Illegal
+	r.Fatal += game.Fatal
+	r.Regressions += game.Regressions
+	r.Errors += game.Errors
+	r.Games = append(r.Games, game)
+}
+
+// A human readable description of the report
+func (r replayReport) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Replayed %v turns of %v games: %v changed, %v illegal, %v fatal, %v regressions, %v errors\n",
+		r.Turns, len(r.Games), r.Changed, r.Illegal, r.Fatal, r.Regressions, r.Errors)
+	for _, game := range r.Games {
+		if game.Error != "" {
+			fmt.Fprintf(&b, "  game %v: %v\n", game.ID, game.Error)
+		}
+		for _, turn := range game.Diffs {
+			fmt.Fprintf(&b, "  game %v turn %v: %v -> %v", game.ID, turn.Turn, turn.Recorded, turn.Replayed)
+			switch {
+			case turn.Error != "":
+				fmt.Fprintf(&b, " (%v)", turn.Error)
+			case turn.Verdict.Reason != "":
+				fmt.Fprintf(&b, " (%v)", turn.Verdict.Reason)
+			}
+			if turn.Regression {
+				b.WriteString(" REGRESSION")
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// Send a recorded request to a snake, returning its response body
+func replayRequest(ctx context.Context, addr string, path string, body []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxRecordedResponse)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return response, fmt.Errorf("Returned Status Code %v", resp.StatusCode)
+	}
+	return response, nil
+}
+
+// Replay one recorded game against the snake at addr
+func replayGame(ctx context.Context, containerName string, addr string, gameId string) replayedGame {
+	result := replayedGame{ID: gameId, Diffs: []replayTurn{}}
+	records, err := games.Read(containerName, gameId)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	return replayRecords(ctx, addr, result, records)
+}
+
+// Send the records of a game to the snake at addr, comparing its moves with
+// the recorded ones
+func replayRecords(ctx context.Context, addr string, result replayedGame, records []games.Record) replayedGame {
+	for _, record := range records {
+		if ctx.Err() != nil {
+			result.Error = ctx.Err().Error()
+			return result
+		}
+		state, err := rules.ParseGameState(record.Request)
+		if err != nil {
+			continue
+		}
+		timeout := time.Duration(state.Game.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = defaultMoveTimeout
+		}
+
+		switch record.Type {
+		case games.RecordStart:
+			replayRequest(ctx, addr, snakeStartPath, record.Request, timeout)
+		case games.RecordEnd:
+			replayRequest(ctx, addr, snakeEndPath, record.Request, timeout)
+		case games.RecordMove:
+			// A fallback was chosen by the manager, not the snake, so there is
+			// nothing to compare against
+			if record.Status != 200 || record.Fallback {
+				continue
+			}
+			result.Turns++
+			recorded := rules.ParseMove(record.Response)
+			start := time.Now()
+			response, err := replayRequest(ctx, addr, snakeMovePath, record.Request, timeout)
+			turn := replayTurn{
+				Turn:            state.Turn,
+				Recorded:        recorded,
+				Replayed:        rules.ParseMove(response),
+				RecordedVerdict: state.Check(recorded),
+				LatencyMs:       float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err != nil {
+				turn.Error = err.Error()
+				result.Errors++
+				result.Diffs = append(result.Diffs, turn)
+				continue
+			}
+			turn.Verdict = state.Check(turn.Replayed)
+			bad := turn.Verdict.Illegal || turn.Verdict.Fatal
+			turn.Regression = bad && !turn.RecordedVerdict.Illegal && !turn.RecordedVerdict.Fatal
+			if turn.Verdict.Illegal {
+				result.Illegal++
+			}
+			if turn.Verdict.Fatal {
+				result.Fatal++
+			}
+			if turn.Regression {
+				result.Regressions++
+			}
+			if turn.Replayed != recorded {
+				result.Changed++
+			}
+			if turn.Replayed != recorded || bad {
+				result.Diffs = append(result.Diffs, turn)
+			}
+		}
+	}
+	return result
+}
+
+// Replay recorded games of a snake against the snake at addr. If gameIds is
+// empty, the most recent count games are replayed.
+func replayGames(ctx context.Context, repoName string, addr string, gameIds []string, count int) (replayReport, error) {
+	containerName := docker.RepoNameToContainerName(repoName)
+	report := replayReport{Snake: repoName, Games: []replayedGame{}}
+	if len(gameIds) == 0 {
+		recorded, err := games.List(containerName)
+		if err != nil {
+			return report, err
+		}
+		for _, game := range recorded[:min(count, len(recorded))] {
+			gameIds = append(gameIds, game.ID)
+		}
+	}
+	if len(gameIds) == 0 {
+		return report, ErrorNoGames
+	}
+
+	for _, gameId := range gameIds {
+		report.add(replayGame(ctx, containerName, addr, gameId))
+	}
+	return report, nil
+}
+
+// Replay recorded games against a temporary container created from image
+func replayImage(ctx context.Context, repoName string, image string, gameIds []string, count int) (replayReport, error) {
+	containerName := docker.RepoNameToContainerName(repoName)
+	addr, remove, err := docker.StartTemporaryContainer(ctx, containerName, image)
+	if err != nil {
+		return replayReport{}, fmt.Errorf("Could not start the snake: %w", err)
+	}
+	defer remove()
+
+	report, err := replayGames(ctx, repoName, addr, gameIds, count)
+	report.Image = image
+	return report, err
+}
+
+// Queue a replay of recorded games against a temporary container created
+// from the image given by `image`, a commit or image id prefix, or from the
+// snake's current image if not given. `game` picks games to replay and
+// `games` how many recent ones to replay otherwise. The report is written to
+// the job's log.
+func adminReplaySnake(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	state, err := docker.GetState(id)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+
+	count := defaultReplayGames
+	if value := r.URL.Query().Get("games"); value != "" {
+		count, err = strconv.Atoi(value)
+		if err != nil || count <= 0 {
+			writeJsonError(w, 400, "games must be a positive number")
+			return
+		}
+	}
+	gameIds := r.URL.Query()["game"]
+	if len(gameIds) == 0 {
+		recorded, err := games.List(id)
+		if err != nil {
+			writeDockerError(w, r, err)
+			return
+		}
+		if len(recorded) == 0 {
+			writeJsonError(w, 404, ErrorNoGames.Error())
+			return
+		}
+	}
+
+	target := imageTarget{ID: docker.RepoNameToImage(state.RepoName)}
+	if image := r.URL.Query().Get("image"); image != "" {
+		target, err = findRollbackTarget(state.RepoName, image)
+		if err == ErrorNoRollbackTarget {
+			writeJsonError(w, 404, "Image not found")
+			return
+		}
+		if err != nil {
+			writeDockerError(w, r, err)
+			return
+		}
+	}
+
+	job, err := enqueueReplay(state.RepoName, target.ID, target.Commit, gameIds, count, triggerAdmin)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	writeJson(w, 202, job)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ttocsneb/battlesnake-manager/games"
+)
+
+// A snake that, like many frameworks, only serves the paths with a trailing
+// slash
+func trailingSlashSnake(t *testing.T, move string) (string, *[]string) {
+	t.Helper()
+	requests := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		switch r.URL.Path {
+		case snakeStartPath, snakeMovePath, snakeEndPath:
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == snakeMovePath {
+			io.WriteString(w, `{"move":"`+move+`"}`)
+		}
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), &requests
+}
+
+const replayTestState string = `{"game":{"id":"g","timeout":500},"turn":4,` +
+	`"board":{"height":11,"width":11,"food":[],"hazards":[],` +
+	`"snakes":[{"id":"you","name":"you","health":90,"body":[{"x":0,"y":5},{"x":1,"y":5},{"x":2,"y":5}]}]},` +
+	`"you":{"id":"you","name":"you","health":90,"body":[{"x":0,"y":5},{"x":1,"y":5},{"x":2,"y":5}]}}`
+
+func replayTestRecords() []games.Record {
+	return []games.Record{
+		{Type: games.RecordStart, Request: []byte(replayTestState)},
+		{Type: games.RecordMove, Turn: 4, Status: 200, Request: []byte(replayTestState), Response: []byte(`{"move":"up"}`)},
+		{Type: games.RecordEnd, Request: []byte(replayTestState)},
+	}
+}
+
+func TestReplayRecordsUsesProxyPaths(t *testing.T) {
+	addr, requests := trailingSlashSnake(t, "up")
+
+	result := replayRecords(context.Background(), addr, replayedGame{ID: "g", Diffs: []replayTurn{}}, replayTestRecords())
+	if result.Turns != 1 || result.Errors != 0 || result.Changed != 0 || len(result.Diffs) != 0 {
+		t.Fatalf("result = %+v", result)
+	}
+	want := []string{snakeStartPath, snakeMovePath, snakeEndPath}
+	if strings.Join(*requests, " ") != strings.Join(want, " ") {
+		t.Fatalf("requests = %v, want %v", *requests, want)
+	}
+}
+
+func TestReplayRecordsFindsRegressions(t *testing.T) {
+	addr, _ := trailingSlashSnake(t, "left")
+
+	result := replayRecords(context.Background(), addr, replayedGame{ID: "g", Diffs: []replayTurn{}}, replayTestRecords())
+	if result.Changed != 1 || result.Fatal != 1 || result.Regressions != 1 {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+func TestReplayRecordsSkipsFallbacks(t *testing.T) {
+	addr, _ := trailingSlashSnake(t, "left")
+	records := replayTestRecords()
+	records[1].Fallback = true
+
+	result := replayRecords(context.Background(), addr, replayedGame{ID: "g", Diffs: []replayTurn{}}, records)
+	if result.Turns != 0 || result.Changed != 0 {
+		t.Fatalf("result = %+v", result)
+	}
+}
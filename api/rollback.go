@@ -0,0 +1,270 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/logging"
+	"github.com/ttocsneb/battlesnake-manager/notify"
+	"github.com/ttocsneb/battlesnake-manager/store"
+)
+
+// How many images are kept for each snake when not configured
+const defaultKeepImages int = 3
+
+var ErrorNoRollbackTarget = errors.New("No image to roll back to")
+var ErrorDeploying = errors.New("A deploy is already running")
+
+var fullCommitPattern *regexp.Regexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// A previously built image of a snake that can be rolled back to
+type imageTarget struct {
+	ID      string    `json:"id"`
+	Commit  string    `json:"commit"`
+	Tags    []string  `json:"tags"`
+	Created time.Time `json:"created"`
+	Current bool      `json:"current"`
+}
+
+// List the images that were built for a repo, newest first
+func listImageTargets(repoName string) ([]imageTarget, error) {
+	images, err := docker.ListImages(docker.RepoNameToImageRepo(repoName))
+	if err != nil {
+		return nil, err
+	}
+	current := docker.RepoNameToImage(repoName)
+
+	result := []imageTarget{}
+	for _, img := range images {
+		target := imageTarget{
+			ID:      img.Id,
+			Tags:    img.RepoTags,
+			Created: time.Unix(img.Created, 0),
+			Current: slices.Contains(img.RepoTags, current),
+		}
+		for _, tag := range img.RepoTags {
+			_, version, _ := strings.Cut(tag, ":")
+			if fullCommitPattern.MatchString(version) {
+				target.Commit = version
+				break
+			}
+		}
+		result = append(result, target)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.After(result[j].Created)
+	})
+	return result, nil
+}
+
+// Delete all but the newest keep images of a repo. The current image is
+// always kept.
+func pruneImages(ctx context.Context, repoName string, keep int) {
+	targets, err := listImageTargets(repoName)
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not get list of container images", "error", err)
+		return
+	}
+
+	kept := 0
+	for _, target := range targets {
+		if target.Current || kept < keep-1 {
+			if !target.Current {
+				kept++
+			}
+			continue
+		}
+
+		slog.InfoContext(ctx, "Removing old image", "image_id", target.ID, "commit", target.Commit)
+		// Remove each tag so that an image shared with another repo is only
+		// untagged
+		for _, tag := range target.Tags {
+			err := docker.RemoveImage(tag, false)
+			if err != nil {
+				slog.ErrorContext(ctx, "Could not remove old image", "tag", tag, "error", err)
+			}
+		}
+		if len(target.Tags) == 0 {
+			if err := docker.RemoveImage(target.ID, false); err != nil {
+				slog.ErrorContext(ctx, "Could not remove old image", "image_id", target.ID, "error", err)
+			}
+		}
+	}
+}
+
+// Find the image to roll back to. target may be a commit or image id prefix.
+// If target is empty, the newest image older than the current one is used.
+func findRollbackTarget(repoName string, target string) (imageTarget, error) {
+	targets, err := listImageTargets(repoName)
+	if err != nil {
+		return imageTarget{}, err
+	}
+
+	if target == "" {
+		seenCurrent := false
+		for _, t := range targets {
+			if t.Current {
+				seenCurrent = true
+				continue
+			}
+			if seenCurrent {
+				return t, nil
+			}
+		}
+		return imageTarget{}, ErrorNoRollbackTarget
+	}
+
+	target = strings.ToLower(target)
+	for _, t := range targets {
+		if t.Commit != "" && strings.HasPrefix(t.Commit, target) {
+			return t, nil
+		}
+		if strings.HasPrefix(strings.TrimPrefix(t.ID, "sha256:"), strings.TrimPrefix(target, "sha256:")) {
+			return t, nil
+		}
+	}
+	return imageTarget{}, ErrorNoRollbackTarget
+}
+
+// Recreate a snake's container from a previously built image without
+// rebuilding it. The rollback is recorded in the deploy history with what
+// triggered it, and its output is kept as a deploy log.
+func rollbackApplication(repoName string, target string, trigger string) (store.Deploy, error) {
+	conf := getBuildConfig(repoName)
+	if conf == nil {
+		return store.Deploy{}, docker.ErrorNotRegistered
+	}
+	if !conf.BuildingMutex.TryLock() {
+		return store.Deploy{}, ErrorDeploying
+	}
+	defer func() {
+		conf.BuildingMutex.Unlock()
+		// Start any deploy that was queued while rolling back
+		scheduleJobs()
+	}()
+
+	image, err := findRollbackTarget(repoName, target)
+	if err != nil {
+		return store.Deploy{}, err
+	}
+
+	containerName := docker.RepoNameToContainerName(repoName)
+	deployId := newDeployId()
+	ctx := logging.With(context.Background(), "deploy_id", deployId, "snake", repoName)
+	slog.InfoContext(ctx, "Rolling back", "image_id", image.ID, "commit", image.Commit, "trigger", trigger)
+
+	var output io.Writer = io.Discard
+	logFile, err := createDeployLog(repoName, deployId)
+	if err != nil {
+		slog.WarnContext(ctx, "Could not create the deploy log", "error", err)
+	} else {
+		defer logFile.Close()
+		output = logFile
+	}
+	fmt.Fprintf(output, "Rollback %v of %v to %v, triggered by %v\n", deployId, repoName, image.ID, trigger)
+
+	store.StartDeploy(containerName, deployId)
+	store.UpdateDeploy(containerName, deployId, func(deploy *store.Deploy) {
+		deploy.Commit = image.Commit
+		deploy.ImageID = image.ID
+		deploy.Rollback = true
+		deploy.Trigger = trigger
+	})
+	notify.Send(ctx, notify.Event{
+		Event:    notify.EventDeployStarted,
+		Snake:    repoName,
+		DeployID: deployId,
+		Ref:      image.Commit,
+		Url:      deployLogUrl(deployId),
+	})
+
+	err = docker.SwapContainer(ctx, containerName, image.ID, output)
+	if err == nil {
+		err = docker.TagImage(image.ID, docker.RepoNameToImage(repoName))
+	}
+	event := notify.Event{
+		Event:    notify.EventDeploySucceeded,
+		Snake:    repoName,
+		DeployID: deployId,
+		Ref:      image.Commit,
+		Commit:   image.Commit,
+		Url:      deployLogUrl(deployId),
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not roll back", "error", err)
+		fmt.Fprintf(output, "Could not roll back: %v\n", err)
+		event.Event = notify.EventDeployFailed
+		event.Error = err.Error()
+		notify.Send(ctx, event)
+		store.FinishDeploy(containerName, deployId, err)
+		deploysMetric.Inc(containerName, store.DeployFailed)
+		return store.Deploy{}, err
+	}
+	fmt.Fprintln(output, "Rolled back successfully")
+	notify.Send(ctx, event)
+	store.FinishDeploy(containerName, deployId, nil)
+	deploysMetric.Inc(containerName, store.DeploySucceeded)
+	slog.InfoContext(ctx, "Successfully rolled back", "container", containerName)
+
+	saved, _ := store.Get(containerName)
+	for _, deploy := range saved.Deploys {
+		if deploy.ID == deployId {
+			return deploy, nil
+		}
+	}
+	return store.Deploy{ID: deployId}, nil
+}
+
+func adminListImages(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	state, err := docker.GetState(id)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	targets, err := listImageTargets(state.RepoName)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	writeJson(w, 200, targets)
+}
+
+// Roll back to the image given by `image`, a commit or image id prefix, or
+// to the previous image if not given. `trigger=cli` records that the
+// rollback came from the rollback command.
+func adminRollbackSnake(w http.ResponseWriter, r *http.Request) {
+	id := "bs-" + mux.Vars(r)["id"]
+	state, err := docker.GetState(id)
+	if err != nil {
+		writeDockerError(w, r, err)
+		return
+	}
+	trigger := triggerAdmin
+	if r.URL.Query().Get("trigger") == triggerCli {
+		trigger = triggerCli
+	}
+
+	deploy, err := rollbackApplication(state.RepoName, r.URL.Query().Get("image"), trigger)
+	switch err {
+	case nil:
+		writeJson(w, 200, deploy)
+	case ErrorNoRollbackTarget:
+		writeJsonError(w, 404, err.Error())
+	case ErrorDeploying:
+		writeJsonError(w, 409, err.Error())
+	default:
+		writeDockerError(w, r, fmt.Errorf("Could not roll back: %w", err))
+	}
+}
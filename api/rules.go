@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Which pushes a snake is deployed from. If Commit is set, the snake is
+// pinned to that commit and pushes are ignored. Otherwise pushes to Branch
+// (the repository's default branch if empty) and to tags matching any of the
+// Tags patterns are deployed.
+type DeployRule struct {
+	Branch string   `json:"branch"`
+	Tags   []string `json:"tags"`
+	Commit string   `json:"commit"`
+}
+
+var commitPattern *regexp.Regexp = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+func (d DeployRule) Validate() error {
+	if d.Commit != "" {
+		if !commitPattern.MatchString(d.Commit) {
+			return fmt.Errorf("Invalid commit %q, expected a hex sha", d.Commit)
+		}
+		if d.Branch != "" || len(d.Tags) != 0 {
+			return errors.New("A pinned commit cannot be combined with a branch or tags")
+		}
+	}
+	if strings.HasPrefix(d.Branch, "-") || strings.HasPrefix(d.Branch, "refs/") {
+		return fmt.Errorf("Invalid branch %q, expected a branch name", d.Branch)
+	}
+	for _, pattern := range d.Tags {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("Invalid tag pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (d DeployRule) matchesTag(tag string) bool {
+	for _, pattern := range d.Tags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe what the rule deploys from
+func (d DeployRule) describe(defaultBranch string) string {
+	if d.Commit != "" {
+		return "commit " + d.Commit
+	}
+	parts := []string{}
+	if d.Branch != "" {
+		parts = append(parts, "branch "+d.Branch)
+	} else if len(d.Tags) == 0 {
+		parts = append(parts, "branch "+defaultBranch)
+	}
+	if len(d.Tags) != 0 {
+		parts = append(parts, "tags "+strings.Join(d.Tags, ", "))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// Check whether a push to ref (such as refs/heads/main) should be deployed
+func (d DeployRule) MatchesPush(ref string, defaultBranch string) bool {
+	if d.Commit != "" {
+		return false
+	}
+	if branch, found := strings.CutPrefix(ref, "refs/heads/"); found {
+		if d.Branch != "" {
+			return branch == d.Branch
+		}
+		return len(d.Tags) == 0 && branch == defaultBranch
+	}
+	if tag, found := strings.CutPrefix(ref, "refs/tags/"); found {
+		return d.matchesTag(tag)
+	}
+	return false
+}
+
+// Find what should be deployed in a fresh clone when no specific ref was
+// requested. An empty result means the clone's HEAD.
+func (d DeployRule) resolveDefault(repoDir string) (string, error) {
+	if d.Commit != "" {
+		return d.Commit, nil
+	}
+	if d.Branch != "" {
+		return d.Branch, nil
+	}
+	if len(d.Tags) == 0 {
+		return "", nil
+	}
+
+	out, err := exec.Command("git", "-C", repoDir, "tag", "--list", "--sort=-creatordate").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range strings.Split(string(out), "\n") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && d.matchesTag(tag) {
+			return tag, nil
+		}
+	}
+	return "", fmt.Errorf("No tags match %v", strings.Join(d.Tags, ", "))
+}
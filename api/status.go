@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Commit status states understood by the GitHub api
+const (
+	statusPending = "pending"
+	statusSuccess = "success"
+	statusFailure = "failure"
+	statusError   = "error"
+)
+
+const defaultStatusApiUrl string = "https://api.github.com"
+const defaultStatusContext string = "battlesnake-manager/deploy"
+
+// How long to wait for the api when posting a status
+const statusTimeout time.Duration = 10 * time.Second
+
+// GitHub limits status descriptions to 140 characters
+const maxStatusDescription int = 140
+
+// Where the manager can be reached from outside, used to link to deploy
+// logs from commit statuses
+var publicUrl atomic.Pointer[string]
+
+func SetPublicUrl(url string) {
+	url = strings.TrimSuffix(url, "/")
+	publicUrl.Store(&url)
+}
+
+// How to report deploys as commit statuses. Statuses are only posted when a
+// token is configured.
+type StatusSettings struct {
+	TokenFile string `json:"token_file"`
+	TokenEnv  string `json:"token_env"`
+	// The base url of a GitHub compatible api, https://api.github.com if
+	// empty
+	ApiUrl string `json:"api_url"`
+	// The name the status is shown under
+	Context string `json:"context"`
+}
+
+func (s StatusSettings) IsSet() bool {
+	return s.TokenFile != "" || s.TokenEnv != ""
+}
+
+func (s StatusSettings) Validate() error {
+	if s.TokenFile != "" && s.TokenEnv != "" {
+		return errors.New("Only one of token_file and token_env may be set")
+	}
+	if s.ApiUrl != "" {
+		parsed, err := url.Parse(s.ApiUrl)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return fmt.Errorf("api_url %q is not an http url", s.ApiUrl)
+		}
+	}
+	if s.IsSet() {
+		if _, err := s.token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s StatusSettings) token() (string, error) {
+	return Credential{TokenFile: s.TokenFile, TokenEnv: s.TokenEnv}.token()
+}
+
+func (s StatusSettings) apiUrl() string {
+	if s.ApiUrl == "" {
+		return defaultStatusApiUrl
+	}
+	return strings.TrimSuffix(s.ApiUrl, "/")
+}
+
+func (s StatusSettings) context() string {
+	if s.Context == "" {
+		return defaultStatusContext
+	}
+	return s.Context
+}
+
+// A signed link to a deploy's log that can be opened without the admin
+// token, empty if the public url is not known
+func deployLogUrl(deployId string) string {
+	base := ""
+	if stored := publicUrl.Load(); stored != nil {
+		base = *stored
+	}
+	if base == "" {
+		return ""
+	}
+	return base + "/logs/" + url.PathEscape(deployId) + "?sig=" + signDeployLink(deployId)
+}
+
+type commitStatusRequest struct {
+	State       string `json:"state"`
+	TargetUrl   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context"`
+}
+
+// Set the status of a commit. Nothing is posted if the snake has no status
+// token. Failures are only logged since they should not fail the deploy.
+func postCommitStatus(ctx context.Context, settings StatusSettings, repoName string, sha string, state string, description string, deployId string) {
+	if !settings.IsSet() || sha == "" {
+		return
+	}
+	// The final status is still posted when the deploy was cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), statusTimeout)
+	defer cancel()
+
+	if runes := []rune(description); len(runes) > maxStatusDescription {
+		description = string(runes[:maxStatusDescription-3]) + "..."
+	}
+	err := sendCommitStatus(ctx, settings, repoName, sha, commitStatusRequest{
+		State:       state,
+		TargetUrl:   deployLogUrl(deployId),
+		Description: description,
+		Context:     settings.context(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not post the commit status", "commit", sha, "state", state, "error", err)
+		return
+	}
+	slog.DebugContext(ctx, "Posted the commit status", "commit", sha, "state", state)
+}
+
+func sendCommitStatus(ctx context.Context, settings StatusSettings, repoName string, sha string, status commitStatusRequest) error {
+	token, err := settings.token()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	endpoint := settings.apiUrl() + "/repos/" + repoName + "/statuses/" + sha
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 && resp.StatusCode != 200 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Returned Status Code %v: %v", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
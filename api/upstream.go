@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many connections are dialed ahead when a game starts
+const predialConnections int = 4
+
+// How many idle connections are kept to each snake
+const maxIdleUpstreamConns int = 16
+
+// How long an idle connection is kept. Snakes commonly close idle
+// connections after a while, so this is kept short.
+const upstreamIdleTimeout time.Duration = 30 * time.Second
+
+// How long a pre-dialed connection is kept. Some servers close connections
+// that have not sent a request after a few seconds, so this is kept well
+// under the common timeouts.
+const maxSpareAge time.Duration = 2 * time.Second
+
+var upstreamDialer *net.Dialer = &net.Dialer{
+	Timeout:   5 * time.Second,
+	KeepAlive: 15 * time.Second,
+}
+
+type spareConn struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+// A pre-dialed connection handed to the transport, so that a request that
+// failed on it can be told apart
+type predialedConn struct {
+	net.Conn
+}
+
+// The connections to one snake. A new upstream is created whenever the
+// snake's address changes.
+type upstream struct {
+	addr      string
+	transport *http.Transport
+	client    *http.Client
+
+	spareMutex sync.Mutex
+	spare      []spareConn
+	dialing    int
+	closed     bool
+}
+
+// upstreams is only changed while holding upstreamsMutex, readers load the
+// published map without locking
+var upstreams atomic.Pointer[map[string]*upstream]
+var upstreamsMutex sync.Mutex
+
+func newUpstream(addr string) *upstream {
+	u := &upstream{addr: addr}
+	u.transport = &http.Transport{
+		DialContext:         u.dial,
+		MaxIdleConns:        maxIdleUpstreamConns,
+		MaxIdleConnsPerHost: maxIdleUpstreamConns,
+		IdleConnTimeout:     upstreamIdleTimeout,
+		DisableCompression:  true,
+	}
+	u.client = &http.Client{Transport: u.transport}
+	return u
+}
+
+// The client used to reach a snake at addr
+func getUpstream(id string, addr string) *upstream {
+	if loaded := upstreams.Load(); loaded != nil {
+		if u, found := (*loaded)[id]; found && u.addr == addr {
+			return u
+		}
+	}
+
+	upstreamsMutex.Lock()
+	defer upstreamsMutex.Unlock()
+
+	current := map[string]*upstream{}
+	if loaded := upstreams.Load(); loaded != nil {
+		current = *loaded
+	}
+	old, found := current[id]
+	if found && old.addr == addr {
+		return old
+	}
+	if found {
+		old.close()
+	}
+	u := newUpstream(addr)
+	next := maps.Clone(current)
+	next[id] = u
+	upstreams.Store(&next)
+	return u
+}
+
+// Close the connections to a snake that is no longer proxied to
+func forgetUpstream(id string) {
+	upstreamsMutex.Lock()
+	defer upstreamsMutex.Unlock()
+
+	loaded := upstreams.Load()
+	if loaded == nil {
+		return
+	}
+	u, found := (*loaded)[id]
+	if !found {
+		return
+	}
+	u.close()
+	next := maps.Clone(*loaded)
+	delete(next, id)
+	upstreams.Store(&next)
+}
+
+// Close idle and spare connections. Requests in flight are unaffected.
+func (u *upstream) close() {
+	u.transport.CloseIdleConnections()
+
+	u.spareMutex.Lock()
+	spare := u.spare
+	u.spare = nil
+	u.closed = true
+	u.spareMutex.Unlock()
+	for _, s := range spare {
+		s.conn.Close()
+	}
+}
+
+// Use a pre-dialed connection if there is one
+func (u *upstream) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if conn := u.takeSpare(); conn != nil {
+		return conn, nil
+	}
+	return upstreamDialer.DialContext(ctx, network, addr)
+}
+
+func (u *upstream) takeSpare() net.Conn {
+	u.spareMutex.Lock()
+	defer u.spareMutex.Unlock()
+
+	now := time.Now()
+	for len(u.spare) > 0 {
+		s := u.spare[len(u.spare)-1]
+		u.spare = u.spare[:len(u.spare)-1]
+		if now.Sub(s.dialed) < maxSpareAge && connAlive(s.conn) {
+			return predialedConn{s.conn}
+		}
+		s.conn.Close()
+	}
+	return nil
+}
+
+// Drop the spare connections, they were most likely closed by the snake
+// together with the one that just failed
+func (u *upstream) dropSpares() {
+	u.spareMutex.Lock()
+	spare := u.spare
+	u.spare = nil
+	u.spareMutex.Unlock()
+	for _, s := range spare {
+		s.conn.Close()
+	}
+}
+
+// Send a request to the snake. The snake may close a pre-dialed connection
+// after it was checked, so a request that fails on one is sent again on a
+// fresh connection.
+func (u *upstream) do(req *http.Request) (*http.Response, error) {
+	predialed := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			_, predialed = info.Conn.(predialedConn)
+		},
+	}
+	resp, err := u.client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil || !predialed || req.Context().Err() != nil || req.GetBody == nil {
+		return resp, err
+	}
+
+	u.dropSpares()
+	body, bodyErr := req.GetBody()
+	if bodyErr != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = body
+	return u.client.Do(retry)
+}
+
+// Dial connections in the background until n are ready to be used, so that
+// the first moves of a game do not wait for a connection
+func (u *upstream) predial(n int) {
+	u.spareMutex.Lock()
+	missing := n - len(u.spare) - u.dialing
+	if missing <= 0 || u.closed {
+		u.spareMutex.Unlock()
+		return
+	}
+	u.dialing += missing
+	u.spareMutex.Unlock()
+
+	for i := 0; i < missing; i++ {
+		go func() {
+			conn, err := upstreamDialer.Dial("tcp", u.addr)
+
+			u.spareMutex.Lock()
+			defer u.spareMutex.Unlock()
+			u.dialing--
+			if err != nil {
+				return
+			}
+			if u.closed {
+				conn.Close()
+				return
+			}
+			u.spare = append(u.spare, spareConn{conn: conn, dialed: time.Now()})
+		}()
+	}
+}
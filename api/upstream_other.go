@@ -0,0 +1,11 @@
+//go:build !unix
+
+package api
+
+import "net"
+
+// The socket cannot be peeked here, requests that fail on a closed
+// connection are retried instead
+func connAlive(conn net.Conn) bool {
+	return true
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !connAlive(conn) {
+		t.Fatal("An open connection is not alive")
+	}
+
+	(<-accepted).Close()
+	time.Sleep(50 * time.Millisecond)
+	if connAlive(conn) {
+		t.Fatal("A closed connection is alive")
+	}
+}
+
+// A snake that closes a pre-dialed connection as soon as a request arrives
+// on it must not make the request fail
+func TestUpstreamRetriesPredialed(t *testing.T) {
+	snake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"move":"up"}`)
+	}))
+	defer snake.Close()
+
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closing.Close()
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	}()
+	spare, err := net.Dial("tcp", closing.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := newUpstream(strings.TrimPrefix(snake.URL, "http://"))
+	defer u.close()
+	u.spare = append(u.spare, spareConn{conn: spare, dialed: time.Now()})
+
+	req, _ := http.NewRequest("POST", snake.URL+snakeMovePath, bytes.NewReader(benchMoveBody))
+	resp, err := u.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != `{"move":"up"}` {
+		t.Fatalf("body = %q", body)
+	}
+}
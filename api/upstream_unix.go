@@ -0,0 +1,30 @@
+//go:build unix
+
+package api
+
+import (
+	"net"
+	"syscall"
+)
+
+// Whether the snake has not closed a connection that was not used yet. The
+// socket is peeked without blocking: a closed connection reads EOF and an
+// open one has nothing to read.
+func connAlive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	alive := false
+	buf := make([]byte, 1)
+	err = raw.Read(func(fd uintptr) bool {
+		_, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		alive = err == syscall.EAGAIN || err == syscall.EWOULDBLOCK
+		return true
+	})
+	return err == nil && alive
+}
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The normalized parts of a push webhook that the manager cares about
+type pushEvent struct {
+	// The full name of the repo, such as owner/repo
+	Repo          string
+	Ref           string
+	After         string
+	Deleted       bool
+	Private       bool
+	DefaultBranch string
+}
+
+const (
+	eventPush  = "push"
+	eventPing  = "ping"
+	eventOther = "other"
+)
+
+// A git host that can send push webhooks
+type webhookProvider interface {
+	Name() string
+	// Whether the request looks like it was sent by this provider
+	Detect(r *http.Request) bool
+	// The kind of event, one of eventPush, eventPing or eventOther
+	Event(r *http.Request) string
+	// The unique id of the delivery, empty if the provider does not send one
+	Delivery(r *http.Request) string
+	// Check that the request was signed with the repo's secret
+	Verify(r *http.Request, body []byte, secret []byte) error
+	// Parse the push payload. Ping payloads are parsed as well so that the
+	// repo can be found.
+	ParsePush(body []byte) (pushEvent, error)
+	// The url a repo is cloned from when none is configured, empty if the
+	// provider has no well known host
+	DefaultCloneUrl(repoName string) string
+}
+
+// The largest webhook payload that is accepted
+const maxWebhookBody int64 = 5 << 20
+
+// How long delivery ids and payloads are remembered to reject replayed
+// webhooks
+const deliveryTTL time.Duration = 24 * time.Hour
+const maxDeliveries int = 10000
+
+var recentDeliveries *recentCache = newRecentCache(deliveryTTL, maxDeliveries)
+
+// Webhooks are limited per source ip before they are verified, and per repo
+// once they are
+var webhookIpLimiter *rateLimiter = newRateLimiter(60, 20)
+var webhookRepoLimiter *rateLimiter = newRateLimiter(12, 5)
+
+var webhookProviders []webhookProvider = []webhookProvider{
+	githubProvider{},
+	gitlabProvider{},
+	// Forgejo sends the Gitea headers as well, so it has to be detected first
+	giteaProvider{"forgejo"},
+	giteaProvider{"gitea"},
+	genericProvider{},
+}
+
+// Check that a snake's provider and clone url settings are usable
+func ValidateProvider(name string, cloneUrl string) error {
+	provider := getWebhookProvider(name)
+	if provider == nil {
+		names := []string{}
+		for _, p := range webhookProviders {
+			names = append(names, p.Name())
+		}
+		return fmt.Errorf("Unknown provider %q, expected one of %v", name, strings.Join(names, ", "))
+	}
+	if cloneUrl == "" && provider.DefaultCloneUrl("owner/repo") == "" {
+		return fmt.Errorf("The %v provider requires a clone_url", provider.Name())
+	}
+	if strings.HasPrefix(cloneUrl, "-") {
+		return fmt.Errorf("Invalid clone url %q", cloneUrl)
+	}
+	return nil
+}
+
+func getWebhookProvider(name string) webhookProvider {
+	if name == "" {
+		name = "github"
+	}
+	for _, provider := range webhookProviders {
+		if provider.Name() == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+func detectWebhookProvider(r *http.Request) webhookProvider {
+	for _, provider := range webhookProviders {
+		if provider.Detect(r) {
+			return provider
+		}
+	}
+	return nil
+}
+
+// Whether a request from the detected provider may deploy a snake that is
+// configured for another. Gitea and Forgejo are interchangeable since they
+// send the same payloads.
+func sameProvider(detected webhookProvider, configured webhookProvider) bool {
+	if detected == configured {
+		return true
+	}
+	_, detectedGitea := detected.(giteaProvider)
+	_, configuredGitea := configured.(giteaProvider)
+	return detectedGitea && configuredGitea
+}
+
+func registerWebhookHandlers(r *mux.Router) {
+	r.HandleFunc("/deploy/", webhookHandler)
+	r.HandleFunc("/deploy/{provider}", webhookHandler)
+	r.HandleFunc("/deploy/{provider}/", webhookHandler)
+}
+
+// Respond with 429 and when to try again
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(429)
+	w.Write([]byte("Too Many Requests"))
+}
+
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if allowed, retryAfter := webhookIpLimiter.allow(ip); !allowed {
+		slog.WarnContext(r.Context(), "Rate limited webhook", "ip", ip)
+		writeRateLimited(w, retryAfter)
+		return
+	}
+
+	var provider webhookProvider
+	if name, found := mux.Vars(r)["provider"]; found {
+		provider = getWebhookProvider(name)
+		if provider != nil && !provider.Detect(r) {
+			provider = nil
+		}
+	} else {
+		provider = detectWebhookProvider(r)
+	}
+	if provider == nil {
+		w.WriteHeader(401)
+		w.Write([]byte("Access Denied"))
+		return
+	}
+
+	contentType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	if strings.TrimSpace(contentType) != "application/json" {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid Content-Type. Only json Supported"))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(413)
+		w.Write([]byte("Request Entity Too Large"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid Request"))
+		return
+	}
+
+	request, err := provider.ParsePush(body)
+	if err != nil || request.Repo == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid Request"))
+		return
+	}
+	repoName := request.Repo
+
+	conf := getBuildConfig(repoName)
+	if conf == nil || !sameProvider(provider, getWebhookProvider(conf.settings().Provider)) {
+		w.WriteHeader(401)
+		w.Write([]byte("Access Denied: "))
+		w.Write([]byte("Not registered"))
+		return
+	}
+
+	if err = provider.Verify(r, body, []byte(conf.settings().Secret)); err != nil {
+		w.WriteHeader(401)
+		w.Write([]byte("Access Denied: "))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if allowed, retryAfter := webhookRepoLimiter.allow(repoName); !allowed {
+		slog.WarnContext(r.Context(), "Rate limited webhook", "snake", repoName)
+		writeRateLimited(w, retryAfter)
+		return
+	}
+
+	// Deliveries are only remembered once they are verified so that forged
+	// requests cannot block real ones. Delivery ids are not signed, so the
+	// signed payload itself is remembered as well.
+	payloadHash := sha256.Sum256(body)
+	deliveries := []string{"payload:" + repoName + ":" + hex.EncodeToString(payloadHash[:])}
+	if delivery := provider.Delivery(r); delivery != "" {
+		deliveries = append(deliveries, provider.Name()+":"+delivery)
+	}
+	forgetDeliveries := func() {
+		for _, delivery := range deliveries {
+			recentDeliveries.remove(delivery)
+		}
+	}
+	for i, delivery := range deliveries {
+		if recentDeliveries.add(delivery) {
+			// Only forget the keys this request added
+			for _, added := range deliveries[:i] {
+				recentDeliveries.remove(added)
+			}
+			slog.WarnContext(r.Context(), "Rejected a replayed webhook", "snake", repoName, "delivery", delivery)
+			w.WriteHeader(409)
+			w.Write([]byte("Duplicate delivery"))
+			return
+		}
+	}
+
+	event := provider.Event(r)
+	if event == eventPing {
+		w.WriteHeader(200)
+		w.Write([]byte("pong"))
+		return
+	}
+
+	if event != eventPush {
+		w.WriteHeader(403)
+		w.Write([]byte("Action Forbidden"))
+		return
+	}
+
+	if request.Private && !conf.settings().Credential.IsSet() {
+		w.WriteHeader(500)
+		w.Write([]byte("Cannot Access Private Repos without a credential"))
+		return
+	}
+
+	rule := conf.settings().Deploy
+	if request.Deleted || !rule.MatchesPush(request.Ref, request.DefaultBranch) {
+		w.WriteHeader(200)
+		w.Write([]byte("Ignoring push to "))
+		w.Write([]byte(request.Ref))
+		w.Write([]byte("\nOnly deploying from "))
+		w.Write([]byte(rule.describe(request.DefaultBranch)))
+		return
+	}
+	if !commitPattern.MatchString(request.After) {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid Request"))
+		return
+	}
+
+	job, err := enqueueDeploy(repoName, request.After, triggerPush)
+	if err != nil {
+		// Let the provider retry the delivery
+		forgetDeliveries()
+		logError(w, r, "Could not queue the deploy", err)
+		return
+	}
+
+	w.WriteHeader(200)
+	if job.State == jobQueued {
+		w.Write([]byte("There is already a job deploying\n"))
+		w.Write([]byte("Queued "))
+	} else {
+		w.Write([]byte("Deploying "))
+	}
+	w.Write([]byte(repoName))
+	w.Write([]byte(" at "))
+	w.Write([]byte(request.After))
+	w.Write([]byte(" as job "))
+	w.Write([]byte(job.ID))
+}
+
+// Whether a commit sha is git's null sha, used for deleted refs
+func isNullCommit(sha string) bool {
+	return sha != "" && strings.Trim(sha, "0") == ""
+}
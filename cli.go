@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ttocsneb/battlesnake-manager/docker"
+)
+
+// Run a subcommand against a running manager. Returns false if args is not a
+// known subcommand.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "rollback":
+		os.Exit(rollbackCommand(args[1:]))
+	}
+	return false
+}
+
+// Roll a snake back to an earlier image through the admin api
+func rollbackCommand(args []string) int {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: main rollback [options] <snake> [commit or image id]")
+		fmt.Fprintln(flags.Output(), "\nRecreate a snake's container from an earlier image. Without a commit,")
+		fmt.Fprintln(flags.Output(), "the image before the current one is used.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	server := flags.String("url", "http://localhost", "The address of the manager")
+	token := flags.String("token", "", "The admin token, read from the config file if not given")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+
+	if *token == "" {
+		config, err := readConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read the admin token from %v: %v\n", configPath, err)
+			return 1
+		}
+		*token = config.AdminToken
+	}
+
+	// Accept either the repo name or the id used in urls
+	snake := flags.Arg(0)
+	id := strings.TrimPrefix(docker.RepoNameToContainerName(snake), "bs-")
+	if strings.HasPrefix(snake, "bs-") {
+		id = strings.TrimPrefix(snake, "bs-")
+	}
+
+	query := url.Values{}
+	query.Set("trigger", "cli")
+	if flags.NArg() == 2 {
+		query.Set("image", flags.Arg(1))
+	}
+	endpoint := strings.TrimSuffix(*server, "/") + "/admin/snakes/" + url.PathEscape(id) + "/rollback?" + query.Encode()
+	req, err := http.NewRequest("POST", endpoint, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != 200 {
+		fmt.Fprintf(os.Stderr, "Rollback failed with status %v\n", resp.StatusCode)
+		return 1
+	}
+	return 0
+}
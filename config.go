@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ttocsneb/battlesnake-manager/api"
+	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/games"
+	"github.com/ttocsneb/battlesnake-manager/logging"
+	"github.com/ttocsneb/battlesnake-manager/notify"
+)
+
+const configPath string = "/data/battlesnakes.json"
+
+type ContainerSetting struct {
+	Name   string            `json:"name"`
+	Secret string            `json:"secret"`
+	Run    docker.RunOptions `json:"run"`
+	Idle   IdlePolicy        `json:"idle"`
+	Deploy api.DeployRule    `json:"deploy"`
+	// How many images to keep for rollbacks, including the current one
+	KeepImages int `json:"keep_images"`
+	// How to authenticate when cloning a private repo
+	Credential api.Credential `json:"credential"`
+	// Which git host sends webhooks for the repo: github (the default),
+	// gitlab, gitea, forgejo or generic
+	Provider string `json:"provider"`
+	// Where to clone the repo from, required for self hosted providers
+	CloneUrl string `json:"clone_url"`
+	// Report deploys as commit statuses on GitHub
+	Status api.StatusSettings `json:"status"`
+	// Record the games the snake plays under /data/games
+	Record games.Settings `json:"record"`
+	// Replay recorded games against new builds before they are deployed
+	Replay api.ReplaySettings `json:"replay"`
+}
+
+func (s ContainerSetting) repoSettings() api.RepoSettings {
+	return api.RepoSettings{
+		Secret:     s.Secret,
+		Deploy:     s.Deploy,
+		KeepImages: s.KeepImages,
+		Credential: s.Credential,
+		Provider:   s.Provider,
+		CloneUrl:   s.CloneUrl,
+		Status:     s.Status,
+		Record:     s.Record,
+		Replay:     s.Replay,
+	}
+}
+
+// The top level of the config file. For backwards compatibility, the file
+// may also be just the list of snakes.
+type Config struct {
+	Log logging.Settings `json:"log"`
+	// The bearer token for the /admin/ api. The api is disabled if empty.
+	AdminToken string `json:"admin_token"`
+	// How many deploys may build at the same time, 1 if not set
+	MaxConcurrentDeploys int `json:"max_concurrent_deploys"`
+	// The url the manager is reachable at, used for the signed deploy log
+	// links in commit statuses and notifications
+	PublicUrl string `json:"public_url"`
+	// Where to send notifications about deploys and crashes
+	Notifications []notify.Target    `json:"notifications"`
+	Idle          IdlePolicy         `json:"idle"`
+	Snakes        []ContainerSetting `json:"snakes"`
+}
+
+// The settings that are currently applied to the registry, keyed by repo name
+var loadedSettings map[string]ContainerSetting = map[string]ContainerSetting{}
+var loadedConfig Config
+var loadedSettingsMutex sync.Mutex
+
+func readConfig() (Config, error) {
+	var result Config
+	body, err := os.ReadFile(configPath)
+	if err != nil {
+		return result, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = decoder.Decode(&result.Snakes)
+	} else {
+		err = decoder.Decode(&result)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	if err = result.Log.Validate(); err != nil {
+		return result, fmt.Errorf("invalid log settings: %w", err)
+	}
+	if err = result.Idle.Validate(); err != nil {
+		return result, fmt.Errorf("invalid idle policy: %w", err)
+	}
+	if result.PublicUrl != "" {
+		parsed, err := url.Parse(result.PublicUrl)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return result, fmt.Errorf("public_url %q is not an http url", result.PublicUrl)
+		}
+	}
+	if result.MaxConcurrentDeploys < 0 {
+		return result, fmt.Errorf("max_concurrent_deploys must not be negative")
+	}
+	for i, target := range result.Notifications {
+		if err = target.Validate(); err != nil {
+			return result, fmt.Errorf("notification %v: %w", i+1, err)
+		}
+	}
+	seen := map[string]bool{}
+	for _, val := range result.Snakes {
+		if val.Name == "" {
+			return result, fmt.Errorf("A battlesnake is missing its name")
+		}
+		if seen[val.Name] {
+			return result, fmt.Errorf("%v is listed more than once", val.Name)
+		}
+		seen[val.Name] = true
+		if err = val.Run.Validate(); err != nil {
+			return result, fmt.Errorf("%v: invalid run options: %w", val.Name, err)
+		}
+		if err = val.Idle.Validate(); err != nil {
+			return result, fmt.Errorf("%v: invalid idle policy: %w", val.Name, err)
+		}
+		if err = val.Deploy.Validate(); err != nil {
+			return result, fmt.Errorf("%v: invalid deploy rule: %w", val.Name, err)
+		}
+		if err = api.ValidateProvider(val.Provider, val.CloneUrl); err != nil {
+			return result, fmt.Errorf("%v: %w", val.Name, err)
+		}
+		if err = val.Credential.Validate(); err != nil {
+			return result, fmt.Errorf("%v: invalid credential: %w", val.Name, err)
+		}
+		if err = val.Status.Validate(); err != nil {
+			return result, fmt.Errorf("%v: invalid status settings: %w", val.Name, err)
+		}
+		if err = val.Record.Validate(); err != nil {
+			return result, fmt.Errorf("%v: invalid record settings: %w", val.Name, err)
+		}
+		if err = val.Replay.Validate(); err != nil {
+			return result, fmt.Errorf("%v: invalid replay settings: %w", val.Name, err)
+		}
+		if val.KeepImages < 0 {
+			return result, fmt.Errorf("%v: keep_images must not be negative", val.Name)
+		}
+	}
+	return result, nil
+}
+
+// Get the idle policy of every registered snake, keyed by container name
+func idlePolicies() map[string]IdlePolicy {
+	loadedSettingsMutex.Lock()
+	defer loadedSettingsMutex.Unlock()
+
+	defaults := loadedConfig.Idle.WithDefaults(builtinIdlePolicy)
+	result := map[string]IdlePolicy{}
+	for name, val := range loadedSettings {
+		result[docker.RepoNameToContainerName(name)] = val.Idle.WithDefaults(defaults)
+	}
+	return result
+}
+
+func loadConfig() error {
+	result, err := readConfig()
+	if err != nil {
+		// The file could not be read
+		slog.Error("Could not load battlesnakes settings, continuing without configuration", "path", configPath, "error", err)
+		return nil
+	}
+
+	applyConfig(result)
+	return nil
+}
+
+func reloadConfig() {
+	result, err := readConfig()
+	if err != nil {
+		slog.Error("Could not reload battlesnakes settings, continuing with the previous configuration", "path", configPath, "error", err)
+		return
+	}
+
+	slog.Info("Reloading battlesnakes settings", "path", configPath)
+	applyConfig(result)
+}
+
+// Forget the settings of a snake that was removed through the admin api, so
+// that the next reload registers it again if it is still listed
+func forgetSnakeSettings(repoName string) {
+	loadedSettingsMutex.Lock()
+	defer loadedSettingsMutex.Unlock()
+
+	delete(loadedSettings, repoName)
+}
+
+// Diff the new settings against the live registry, registering new snakes,
+// updating changed ones and unregistering the ones that were removed.
+func applyConfig(config Config) {
+	loadedSettingsMutex.Lock()
+	defer loadedSettingsMutex.Unlock()
+
+	logging.Setup(config.Log)
+
+	next := map[string]ContainerSetting{}
+	added := []string{}
+	for _, val := range config.Snakes {
+		next[val.Name] = val
+		old, found := loadedSettings[val.Name]
+		if !found {
+			slog.Info("Registering repo", "snake", val.Name)
+			docker.RegisterContainer(val.Name, val.Run)
+			api.RegisterRepo(val.Name, val.repoSettings())
+			added = append(added, val.Name)
+			continue
+		}
+		if !reflect.DeepEqual(old.repoSettings(), val.repoSettings()) {
+			slog.Info("Updating repo settings", "snake", val.Name)
+			api.RegisterRepo(val.Name, val.repoSettings())
+		}
+		if !reflect.DeepEqual(old.Run, val.Run) {
+			slog.Info("Updating run options, they will apply on the next deploy", "snake", val.Name)
+			docker.RegisterContainer(val.Name, val.Run)
+		}
+	}
+
+	for name := range loadedSettings {
+		if _, found := next[name]; found {
+			continue
+		}
+		slog.Info("Unregistering repo", "snake", name)
+		api.UnregisterRepo(name)
+		containerName := docker.RepoNameToContainerName(name)
+		err := docker.StopContainer(context.Background(), containerName)
+		if err != nil && err != docker.ErrorDoesNotExist {
+			slog.Error("Could not stop container", "snake", name, "error", err)
+		}
+		docker.UnregisterContainer(name)
+	}
+
+	loadedSettings = next
+	loadedConfig = config
+	api.SetAdminToken(config.AdminToken)
+	api.SetMaxConcurrentDeploys(config.MaxConcurrentDeploys)
+	api.SetPublicUrl(config.PublicUrl)
+	if err := notify.Setup(config.Notifications); err != nil {
+		slog.Error("Could not set up notifications", "error", err)
+	}
+
+	// Deploy any non-existing repos
+	for _, name := range added {
+		containerName := docker.RepoNameToContainerName(name)
+		_, err := docker.CheckContainer(containerName)
+		if err != nil {
+			if err == docker.ErrorDoesNotExist {
+				go api.DeployApplicationPublic(name)
+			} else {
+				slog.Error("Could not check container status", "snake", name, "error", err)
+			}
+		}
+	}
+}
+
+// Reload the config whenever the file changes or a SIGHUP is received
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	modTime := func() time.Time {
+		info, err := os.Stat(configPath)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	lastMod := modTime()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			lastMod = modTime()
+			reloadConfig()
+		case <-ticker.C:
+			mod := modTime()
+			if !mod.Equal(lastMod) {
+				lastMod = mod
+				reloadConfig()
+			}
+		}
+	}
+}
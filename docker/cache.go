@@ -1,20 +1,93 @@
 package docker
 
 import (
+	"log/slog"
+	"maps"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/ttocsneb/battlesnake-manager/store"
 )
 
 type ContainerState struct {
+	RepoName   string
 	Running    bool
 	Paused     bool
 	LastUsed   *time.Time
 	IPAddress  string
 	LastUpdate *time.Time
+	Options    RunOptions
+	// The image the container is created from
+	Image string
+	// Whether the container was found the last time it was checked
+	Exists bool
+	// Whether the snake has answered requests since it was last started
+	Ready bool
+	// The status of the image's HEALTHCHECK, empty if it does not define one
+	Health string
+
+	// Shared by every copy of the state, so that the times can change
+	// without publishing a new snapshot
+	clock *containerClock
+}
+
+// When a container was last used, when that was last saved and when its
+// state was last inspected, in unix nanoseconds
+type containerClock struct {
+	used    atomic.Int64
+	saved   atomic.Int64
+	updated atomic.Int64
+}
+
+// The host:port the snake can be reached at
+func (s ContainerState) Address() string {
+	return net.JoinHostPort(s.IPAddress, strconv.Itoa(s.Options.GetPort()))
 }
 
+// How often the last use of a busy container is saved to the store
+const usageSaveInterval time.Duration = time.Minute
+
+// How long an inspected state is trusted before it is refreshed while docker
+// events are not being followed
+const staleAfter time.Duration = 1 * time.Second
+
+// containerStates is only changed while holding containerStateMutext. Every
+// change that readers act on publishes a copy to stateSnapshot so that
+// readers never take the lock.
 var containerStates map[string]ContainerState = map[string]ContainerState{}
-var containerStateMutext sync.RWMutex
+var containerStateMutext sync.Mutex
+var stateSnapshot atomic.Pointer[map[string]ContainerState]
+
+// Containers that are being inspected in the background
+var refreshing map[string]bool = map[string]bool{}
+var refreshingMutex sync.Mutex
+
+func publishUnsafe() {
+	snapshot := maps.Clone(containerStates)
+	stateSnapshot.Store(&snapshot)
+}
+
+// Store a changed state, publishing it only if something readers act on
+// changed
+func saveStateUnsafe(name string, state ContainerState) {
+	before := containerStates[name]
+	containerStates[name] = state
+	if before.Running != state.Running || before.Paused != state.Paused ||
+		before.IPAddress != state.IPAddress || before.Health != state.Health ||
+		before.Ready != state.Ready || before.Exists != state.Exists {
+		publishUnsafe()
+	}
+}
+
+func snapshot() map[string]ContainerState {
+	if states := stateSnapshot.Load(); states != nil {
+		return *states
+	}
+	return nil
+}
 
 func isRegisteredUnsafe(name string) bool {
 	_, found := containerStates[name]
@@ -22,62 +95,123 @@ func isRegisteredUnsafe(name string) bool {
 }
 
 func IsRegistered(name string) bool {
-	containerStateMutext.RLock()
-	defer containerStateMutext.RUnlock()
-
-	_, found := containerStates[name]
+	_, found := snapshot()[name]
 	return found
 }
 
-func GetState(name string) (ContainerState, error) {
-	containerStateMutext.RLock()
-	defer containerStateMutext.RUnlock()
+// Fill in the times, which are not kept in the snapshot
+func (s ContainerState) withTimes() ContainerState {
+	if s.clock == nil {
+		return s
+	}
+	if used := s.clock.used.Load(); used != 0 {
+		t := time.Unix(0, used)
+		s.LastUsed = &t
+	}
+	if updated := s.clock.updated.Load(); updated != 0 {
+		t := time.Unix(0, updated)
+		s.LastUpdate = &t
+	}
+	return s
+}
 
-	state, found := containerStates[name]
+func GetState(name string) (ContainerState, error) {
+	state, found := snapshot()[name]
 	if !found {
 		return state, ErrorNotRegistered
 	}
-	return state, nil
+	return state.withTimes(), nil
 }
 
 func IterContainers(yield func(name string, container ContainerState) bool) {
-	containerStateMutext.RLock()
-	defer containerStateMutext.RUnlock()
-
-	for k, v := range containerStates {
-		if !yield(k, v) {
+	for k, v := range snapshot() {
+		if !yield(k, v.withTimes()) {
 			return
 		}
 	}
 }
 
-func IsStale(name string) bool {
-	containerStateMutext.RLock()
-	defer containerStateMutext.RUnlock()
+// A state is only trusted for a short while, unless docker events keep it up
+// to date
+func (s ContainerState) isStale(now time.Time) bool {
+	if s.clock == nil || s.clock.updated.Load() == 0 {
+		return true
+	}
+	return !eventsConnected.Load() && now.UnixNano()-s.clock.updated.Load() > int64(staleAfter)
+}
 
-	container, found := containerStates[name]
+func IsStale(name string) bool {
+	container, found := snapshot()[name]
 	if !found {
 		return true
 	}
-	if container.LastUpdate == nil {
-		return true
+	return container.isStale(time.Now())
+}
+
+// Inspect a container without making the caller wait. Only one inspect of a
+// container runs at a time.
+func refreshInBackground(name string) {
+	refreshingMutex.Lock()
+	if refreshing[name] {
+		refreshingMutex.Unlock()
+		return
 	}
-	return time.Now().After((*container.LastUpdate).Add(1 * time.Second))
+	refreshing[name] = true
+	refreshingMutex.Unlock()
+
+	go func() {
+		defer func() {
+			refreshingMutex.Lock()
+			delete(refreshing, name)
+			refreshingMutex.Unlock()
+		}()
+		_, err := CheckContainer(name)
+		if err != nil && err != ErrorDoesNotExist && err != ErrorNotRegistered {
+			slog.Warn("Could not refresh the container state", "container", name, "error", err)
+		}
+	}()
 }
 
-func RegisterContainer(repoName string) {
+// The address of a container that is known to be ready for requests. A stale
+// state is refreshed in the background and still used, since the container
+// is unlikely to have changed. ok is false if the container has to be
+// started, unpaused or waited on first.
+func ReadyAddress(name string) (addr string, ok bool) {
+	state, found := snapshot()[name]
+	if !found || !state.Exists || !state.Running || state.Paused || !state.Ready {
+		return "", false
+	}
+	if state.isStale(time.Now()) {
+		refreshInBackground(name)
+	}
+	return state.Address(), true
+}
+
+// Register a container, or update the run options of an already registered
+// one. The options take effect the next time the container is created.
+func RegisterContainer(repoName string, options RunOptions) {
 	containerStateMutext.Lock()
 	defer containerStateMutext.Unlock()
 
 	containerName := RepoNameToContainerName(repoName)
 
-	if !isRegisteredUnsafe(containerName) {
-		state := ContainerState{}
-		containerStates[containerName] = state
+	state, found := containerStates[containerName]
+	if !found {
+		state.clock = &containerClock{}
+		// Pick up where the manager left off before it was restarted
+		if saved, found := store.Get(containerName); found && saved.LastUsed != nil {
+			state.clock.used.Store(saved.LastUsed.UnixNano())
+			state.clock.saved.Store(saved.LastUsed.UnixNano())
+		}
 	}
+	state.RepoName = repoName
+	state.Options = options
+	state.Image = RepoNameToImage(repoName)
+	containerStates[containerName] = state
+	publishUnsafe()
 }
 
-func updateState(name string, running bool, paused bool, ip string) error {
+func updateState(name string, running bool, paused bool, ip string, health string) error {
 	containerStateMutext.Lock()
 	defer containerStateMutext.Unlock()
 
@@ -85,12 +219,16 @@ func updateState(name string, running bool, paused bool, ip string) error {
 	if !found {
 		return ErrorNotRegistered
 	}
+	if !running || ip != state.IPAddress {
+		state.Ready = false
+	}
 	state.Running = running
 	state.Paused = paused
 	state.IPAddress = ip
-	t := time.Now()
-	state.LastUpdate = &t
-	containerStates[name] = state
+	state.Health = health
+	state.Exists = true
+	state.clock.updated.Store(time.Now().UnixNano())
+	saveStateUnsafe(name, state)
 
 	return nil
 }
@@ -104,9 +242,29 @@ func updateRunning(name string, running bool, paused bool) error {
 	}
 	state.Running = running
 	state.Paused = paused
-	t := time.Now()
-	state.LastUpdate = &t
-	containerStates[name] = state
+	if !running {
+		state.Ready = false
+	}
+	state.clock.updated.Store(time.Now().UnixNano())
+	saveStateUnsafe(name, state)
+
+	return nil
+}
+func updateMissing(name string) error {
+	containerStateMutext.Lock()
+	defer containerStateMutext.Unlock()
+
+	state, found := containerStates[name]
+	if !found {
+		return ErrorNotRegistered
+	}
+	state.Running = false
+	state.Paused = false
+	state.IPAddress = ""
+	state.Exists = false
+	state.Ready = false
+	state.clock.updated.Store(time.Now().UnixNano())
+	saveStateUnsafe(name, state)
 
 	return nil
 }
@@ -119,14 +277,13 @@ func updatePaused(name string, paused bool) error {
 		return ErrorNotRegistered
 	}
 	state.Paused = paused
-	t := time.Now()
-	state.LastUpdate = &t
-	containerStates[name] = state
+	state.clock.updated.Store(time.Now().UnixNano())
+	saveStateUnsafe(name, state)
 
 	return nil
 }
 
-func UpdateUsed(name string) error {
+func updateReady(name string, ready bool) error {
 	containerStateMutext.Lock()
 	defer containerStateMutext.Unlock()
 
@@ -134,10 +291,39 @@ func UpdateUsed(name string) error {
 	if !found {
 		return ErrorNotRegistered
 	}
+	state.Ready = ready
+	saveStateUnsafe(name, state)
+
+	return nil
+}
+
+// Mark a container as used. This is called for every proxied request, so it
+// neither locks nor publishes a new snapshot, and a busy container is only
+// saved to the store once in a while.
+func UpdateUsed(name string) error {
+	state, found := snapshot()[name]
+	if !found {
+		return ErrorNotRegistered
+	}
 	t := time.Now()
-	state.LastUsed = &t
+	now := t.UnixNano()
+	state.clock.used.Store(now)
 
-	containerStates[name] = state
+	saved := state.clock.saved.Load()
+	if now-saved < int64(usageSaveInterval) || !state.clock.saved.CompareAndSwap(saved, now) {
+		return nil
+	}
+	store.Update(name, func(snake *store.Snake) {
+		snake.LastUsed = &t
+	})
 
 	return nil
 }
+
+func UnregisterContainer(repoName string) {
+	containerStateMutext.Lock()
+	defer containerStateMutext.Unlock()
+
+	delete(containerStates, RepoNameToContainerName(repoName))
+	publishUnsafe()
+}
@@ -0,0 +1,341 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve a fake Engine API on a unix socket and point the package at it
+func fakeEngine(t *testing.T, handler http.Handler) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Start()
+
+	previous := socketPath
+	SetSocketPath(path)
+	t.Cleanup(func() {
+		server.Close()
+		SetSocketPath(previous)
+	})
+}
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   error
+	}{
+		{name: "not found", status: 404, body: `{"message":"No such container: bs-a"}`, want: ErrorDoesNotExist},
+		{name: "conflict", status: 409, body: `{"message":"container is running"}`, want: ErrorConflict},
+		{name: "json message", status: 500, body: `{"message":"driver failed"}`, want: &APIError{StatusCode: 500, Message: "driver failed"}},
+		{name: "plain message", status: 400, body: "bad parameter\n", want: &APIError{StatusCode: 400, Message: "bad parameter"}},
+		{name: "no message", status: 503, body: "", want: &APIError{StatusCode: 503}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "DELETE" || r.URL.Path != "/containers/bs-a" {
+					t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+				}
+				if r.URL.Query().Get("force") != "true" {
+					t.Errorf("force = %q, want true", r.URL.Query().Get("force"))
+				}
+				w.WriteHeader(test.status)
+				io.WriteString(w, test.body)
+			}))
+
+			err := RemoveContainer("bs-a", true)
+			var apiErr *APIError
+			if errors.As(test.want, &apiErr) {
+				var got *APIError
+				if !errors.As(err, &got) || *got != *apiErr {
+					t.Fatalf("RemoveContainer() = %#v, want %#v", err, apiErr)
+				}
+				return
+			}
+			if err != test.want {
+				t.Fatalf("RemoveContainer() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRemoveContainer(t *testing.T) {
+	fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	if err := RemoveContainer("bs-a", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateContainer(t *testing.T) {
+	fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/containers/create" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		if name := r.URL.Query().Get("name"); name != "bs-owner-repo" {
+			t.Errorf("name = %q", name)
+		}
+		var body struct {
+			Image string `json:"Image"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if body.Image != "owner/repo:local" {
+			t.Errorf("Image = %q", body.Image)
+		}
+		w.WriteHeader(201)
+		io.WriteString(w, `{"Id":"abc123","Warnings":[]}`)
+	}))
+
+	id, err := CreateContainer("bs-owner-repo", "owner/repo:local", RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "abc123" {
+		t.Fatalf("id = %q, want abc123", id)
+	}
+}
+
+func TestCreateContainerConflict(t *testing.T) {
+	fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(409)
+		io.WriteString(w, `{"message":"name already in use"}`)
+	}))
+
+	_, err := CreateContainer("bs-owner-repo", "owner/repo:local", RunOptions{})
+	if err != ErrorConflict {
+		t.Fatalf("CreateContainer() = %v, want %v", err, ErrorConflict)
+	}
+}
+
+func TestListImages(t *testing.T) {
+	fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/images/json" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil {
+			t.Error(err)
+		}
+		if !slices.Equal(filters["reference"], []string{"owner/repo"}) {
+			t.Errorf("filters = %v", filters)
+		}
+		io.WriteString(w, `[{"Id":"sha256:1","RepoTags":["owner/repo:local","owner/repo:abc"],"Created":10}]`)
+	}))
+
+	images, err := ListImages("owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Id != "sha256:1" || len(images[0].RepoTags) != 2 || images[0].Created != 10 {
+		t.Fatalf("images = %+v", images)
+	}
+}
+
+func TestRemoveImage(t *testing.T) {
+	fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" || r.URL.Path != "/images/sha256:1" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		if r.URL.Query().Get("force") != "false" {
+			t.Errorf("force = %q, want false", r.URL.Query().Get("force"))
+		}
+		io.WriteString(w, `[{"Deleted":"sha256:1"}]`)
+	}))
+
+	if err := RemoveImage("sha256:1", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildImage(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantId  string
+		wantErr string
+		output  string
+	}{
+		{
+			name:   "success",
+			status: 200,
+			body: `{"stream":"Step 1/2 : FROM scratch\n"}
+{"stream":"Step 2/2 : COPY . .\n"}
+{"aux":{"ID":"sha256:built"}}
+{"stream":"Successfully built\n"}
+`,
+			wantId: "sha256:built",
+			output: "Step 1/2 : FROM scratch\nStep 2/2 : COPY . .\nSuccessfully built\n",
+		},
+		{
+			name:   "error detail",
+			status: 200,
+			body: `{"stream":"Step 1/1 : RUN false\n"}
+{"error":"The command returned a non-zero code","errorDetail":{"message":"The command '/bin/sh -c false' returned a non-zero code: 1"}}
+`,
+			wantErr: "Returned Status Code 200: The command '/bin/sh -c false' returned a non-zero code: 1",
+			output:  "Step 1/1 : RUN false\n",
+		},
+		{
+			name:    "error without detail",
+			status:  200,
+			body:    `{"error":"pull access denied"}`,
+			wantErr: "Returned Status Code 200: pull access denied",
+		},
+		{
+			name:    "no image",
+			status:  200,
+			body:    `{"stream":"nothing\n"}`,
+			wantErr: "The build did not produce an image",
+			output:  "nothing\n",
+		},
+		{
+			name:    "rejected",
+			status:  500,
+			body:    `{"message":"Cannot locate specified Dockerfile: Dockerfile"}`,
+			wantErr: "Returned Status Code 500: Cannot locate specified Dockerfile: Dockerfile",
+		},
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\n"), 0o640)
+	os.Mkdir(filepath.Join(dir, ".git"), 0o750)
+	os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0o640)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" || r.URL.Path != "/build" {
+					t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+				}
+				if tags := r.URL.Query()["t"]; !slices.Equal(tags, []string{"owner/repo:abc", "owner/repo:local"}) {
+					t.Errorf("tags = %v", tags)
+				}
+				files := []string{}
+				archive := tar.NewReader(r.Body)
+				for {
+					header, err := archive.Next()
+					if err != nil {
+						break
+					}
+					files = append(files, header.Name)
+				}
+				if !slices.Equal(files, []string{"Dockerfile"}) {
+					t.Errorf("build context = %v, want only the Dockerfile", files)
+				}
+				w.WriteHeader(test.status)
+				io.WriteString(w, test.body)
+			}))
+
+			var output strings.Builder
+			id, err := BuildImage(context.Background(), dir, []string{"owner/repo:abc", "owner/repo:local"}, &output)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("BuildImage() error = %v, want %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if id != test.wantId {
+				t.Errorf("id = %q, want %q", id, test.wantId)
+			}
+			if output.String() != test.output {
+				t.Errorf("output = %q, want %q", output.String(), test.output)
+			}
+		})
+	}
+}
+
+func TestBuildImageDockerignore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Dockerfile":          "FROM scratch\n",
+		".dockerignore":       "# Only what the image needs\n*\n!src\nsrc/**/*_test.go\n",
+		"README.md":           "readme\n",
+		"src/main.go":         "package main\n",
+		"src/main_test.go":    "package main\n",
+		"src/lib/lib.go":      "package lib\n",
+		"src/lib/lib_test.go": "package lib\n",
+		"node_modules/x.js":   "x\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0o750)
+		os.WriteFile(path, []byte(content), 0o640)
+	}
+
+	var sent []string
+	fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archive := tar.NewReader(r.Body)
+		for {
+			header, err := archive.Next()
+			if err != nil {
+				break
+			}
+			sent = append(sent, header.Name)
+		}
+		io.WriteString(w, `{"aux":{"ID":"sha256:built"}}`)
+	}))
+
+	if _, err := BuildImage(context.Background(), dir, []string{"owner/repo:local"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(sent)
+	want := []string{".dockerignore", "Dockerfile", "src", "src/lib", "src/lib/lib.go", "src/main.go"}
+	if !slices.Equal(sent, want) {
+		t.Errorf("build context = %v, want %v", sent, want)
+	}
+}
+
+// The first health check only runs after the HEALTHCHECK's interval, which
+// must not hold up a snake that already answers
+func TestWaitReadyWhileStarting(t *testing.T) {
+	snake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"apiversion":"1"}`)
+	}))
+	defer snake.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(snake.URL, "http://"))
+	portNumber, _ := strconv.Atoi(port)
+
+	fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"State":{"Running":true,"Health":{"Status":"starting"}},`+
+			`"NetworkSettings":{"Networks":{"bridge":{"IPAddress":"127.0.0.1"}}}}`)
+	}))
+	RegisterContainer("owner/starting", RunOptions{Port: portNumber})
+	defer UnregisterContainer("owner/starting")
+	name := RepoNameToContainerName("owner/starting")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := EnsureContainerReady(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := GetState(name); !state.Ready || state.Health != "starting" {
+		t.Fatalf("state = %+v", state)
+	}
+}
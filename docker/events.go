@@ -0,0 +1,210 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of container events that the manager did not cause
+const (
+	ContainerCrashed   = "crashed"
+	ContainerUnhealthy = "unhealthy"
+)
+
+// How long a stop or removal by the manager explains a container exiting
+const expectedExitWindow time.Duration = time.Minute
+
+const maxEventsBackoff time.Duration = 30 * time.Second
+
+// The container actions that change the state the manager keeps
+var watchedActions []string = []string{"start", "die", "pause", "unpause", "oom", "destroy", "rename", "health_status"}
+
+// Something that happened to a registered container without the manager
+// asking for it
+type ContainerEvent struct {
+	Kind     string
+	Name     string
+	RepoName string
+	Reason   string
+}
+
+// Whether the events stream is connected. While it is, cached states are
+// kept up to date by events and are never stale.
+var eventsConnected atomic.Bool
+
+// Containers the manager is stopping or removing, and when
+var expectedExits map[string]time.Time = map[string]time.Time{}
+var expectedExitsMutex sync.Mutex
+
+func EventsConnected() bool {
+	return eventsConnected.Load()
+}
+
+// Remember that a container is about to exit because the manager asked it to
+func expectExit(name string) {
+	expectedExitsMutex.Lock()
+	defer expectedExitsMutex.Unlock()
+
+	expectedExits[name] = time.Now()
+}
+
+// Whether a container exiting was caused by the manager
+func exitExpected(name string) bool {
+	expectedExitsMutex.Lock()
+	defer expectedExitsMutex.Unlock()
+
+	now := time.Now()
+	for other, at := range expectedExits {
+		if now.Sub(at) > expectedExitWindow {
+			delete(expectedExits, other)
+		}
+	}
+	_, found := expectedExits[name]
+	return found
+}
+
+type eventMessage struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// Follow the docker events of the manager's containers, keeping their cached
+// state up to date and reporting crashes and failing health checks to
+// handle. The stream is reconnected when it breaks, and every container is
+// inspected again since events may have been missed. Returns when ctx is
+// done.
+func WatchEvents(ctx context.Context, handle func(ContainerEvent)) {
+	delay := time.Second
+	for {
+		connected := time.Now()
+		err := followEvents(ctx, handle)
+		eventsConnected.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(connected) > maxEventsBackoff {
+			delay = time.Second
+		}
+		slog.WarnContext(ctx, "Lost the docker events stream, polling until it is back", "error", err, "retry_in", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxEventsBackoff)
+	}
+}
+
+func followEvents(ctx context.Context, handle func(ContainerEvent)) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": watchedActions,
+	})
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://localhost/events?filters="+url.QueryEscape(string(filters)), nil)
+	resp, err := dockerExec(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return responseError(resp)
+	}
+
+	// Events are only delivered from the time the stream was opened, so
+	// anything that happened before is picked up by inspecting everything
+	resync(handle)
+	eventsConnected.Store(true)
+	slog.InfoContext(ctx, "Following docker events")
+
+	// Containers that ran out of memory, so that the following die event can
+	// say why
+	oomKilled := map[string]bool{}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event eventMessage
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		name := event.Actor.Attributes["name"]
+		if event.Type != "container" || !strings.HasPrefix(name, "bs-") || !IsRegistered(name) {
+			continue
+		}
+		action, _, _ := strings.Cut(event.Action, ":")
+		slog.DebugContext(ctx, "Docker event", "container", name, "action", event.Action)
+
+		reason := ""
+		switch action {
+		case "oom":
+			slog.WarnContext(ctx, "Container ran out of memory", "container", name)
+			oomKilled[name] = true
+			continue
+		case "die":
+			reason = "The container exited"
+			if code := event.Actor.Attributes["exitCode"]; code != "" {
+				reason += " with code " + code
+			}
+			if oomKilled[name] {
+				reason = "The container ran out of memory"
+			}
+			delete(oomKilled, name)
+		case "destroy":
+			reason = "The container was removed"
+		}
+		refresh(name, reason, handle)
+	}
+}
+
+// Inspect every registered container, reporting the ones that changed while
+// no events were received
+func resync(handle func(ContainerEvent)) {
+	names := []string{}
+	IterContainers(func(name string, container ContainerState) bool {
+		names = append(names, name)
+		return true
+	})
+	for _, name := range names {
+		refresh(name, "The container stopped while the manager was not watching", handle)
+	}
+}
+
+// Inspect a container and report it if it stopped or became unhealthy
+// without the manager causing it
+func refresh(name string, reason string, handle func(ContainerEvent)) {
+	before, err := GetState(name)
+	if err != nil {
+		return
+	}
+	_, err = CheckContainer(name)
+	if err == ErrorNotRegistered {
+		return
+	}
+	if err != nil && err != ErrorDoesNotExist {
+		slog.Error("Could not check container", "container", name, "error", err)
+		return
+	}
+	after, err := GetState(name)
+	if err != nil {
+		return
+	}
+
+	if before.Running && !after.Running && !exitExpected(name) {
+		if reason == "" {
+			reason = "The container exited"
+		}
+		handle(ContainerEvent{Kind: ContainerCrashed, Name: name, RepoName: after.RepoName, Reason: reason})
+	} else if after.Running && after.Health == "unhealthy" && before.Health != "unhealthy" {
+		handle(ContainerEvent{Kind: ContainerUnhealthy, Name: name, RepoName: after.RepoName, Reason: "The health check is failing"})
+	}
+}
@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"sync"
+	"time"
+)
+
+type activeGame struct {
+	Timeout  time.Duration
+	LastSeen time.Time
+}
+
+// Whether the engine has stopped talking to us about this game
+func (g activeGame) isStale(now time.Time) bool {
+	return now.Sub(g.LastSeen) > 30*time.Second+10*g.Timeout
+}
+
+// The games each container is currently playing, keyed by container name and
+// then game id
+var activeGames map[string]map[string]activeGame = map[string]map[string]activeGame{}
+var activeGamesMutex sync.Mutex
+
+// Record that a container has started playing a game. While a container has
+// active games, it should be kept running.
+func StartGame(name string, gameId string, timeout time.Duration) {
+	activeGamesMutex.Lock()
+	defer activeGamesMutex.Unlock()
+
+	games, found := activeGames[name]
+	if !found {
+		games = map[string]activeGame{}
+		activeGames[name] = games
+	}
+	games[gameId] = activeGame{
+		Timeout:  timeout,
+		LastSeen: time.Now(),
+	}
+}
+
+// Record that a game is still in progress
+func TouchGame(name string, gameId string) {
+	activeGamesMutex.Lock()
+	defer activeGamesMutex.Unlock()
+
+	games, found := activeGames[name]
+	if !found {
+		return
+	}
+	game, found := games[gameId]
+	if !found {
+		return
+	}
+	game.LastSeen = time.Now()
+	games[gameId] = game
+}
+
+func EndGame(name string, gameId string) {
+	activeGamesMutex.Lock()
+	defer activeGamesMutex.Unlock()
+
+	games, found := activeGames[name]
+	if !found {
+		return
+	}
+	delete(games, gameId)
+	if len(games) == 0 {
+		delete(activeGames, name)
+	}
+}
+
+// Get the number of games a container is playing, forgetting any games that
+// have gone stale.
+func ActiveGames(name string) int {
+	activeGamesMutex.Lock()
+	defer activeGamesMutex.Unlock()
+
+	games, found := activeGames[name]
+	if !found {
+		return 0
+	}
+	now := time.Now()
+	for id, game := range games {
+		if game.isStale(now) {
+			delete(games, id)
+		}
+	}
+	if len(games) == 0 {
+		delete(activeGames, name)
+	}
+	return len(games)
+}
+
+// Forget every game of a container that is no longer managed
+func ForgetGames(name string) {
+	activeGamesMutex.Lock()
+	defer activeGamesMutex.Unlock()
+
+	delete(activeGames, name)
+}
@@ -0,0 +1,241 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+)
+
+type ImageSummary struct {
+	Id       string   `json:"Id"`
+	RepoTags []string `json:"RepoTags"`
+	Created  int64    `json:"Created"`
+}
+
+// List all the images that match a reference such as `owner/repo`
+func ListImages(reference string) ([]ImageSummary, error) {
+	filters, err := json.Marshal(map[string][]string{
+		"reference": {reference},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/images/json?filters="+url.QueryEscape(string(filters)), nil)
+	var result []ImageSummary
+	err = dockerExecJson(req, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func RemoveImage(id string, force bool) error {
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("http://localhost/images/%v?force=%v", id, force), nil)
+	var result []map[string]string
+	return dockerExecJson(req, &result)
+}
+
+// Give an image an additional tag such as `owner/repo:local`
+func TagImage(image string, tag string) error {
+	repo, version, found := strings.Cut(tag, ":")
+	if !found {
+		version = "latest"
+	}
+	query := url.Values{}
+	query.Set("repo", repo)
+	query.Set("tag", version)
+	req, _ := http.NewRequest("POST", "http://localhost/images/"+image+"/tag?"+query.Encode(), nil)
+	resp, err := dockerExec(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 200 || resp.StatusCode == 201 {
+		return nil
+	}
+	return responseError(resp)
+}
+
+// Read the patterns of the .dockerignore file in dir. Returns nil if there
+// is none.
+func readDockerignore(dir string) (*patternmatcher.PatternMatcher, error) {
+	f, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	patterns, err := ignorefile.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return patternmatcher.New(patterns)
+}
+
+// Write the build context in dir to w as a tar archive, leaving out the
+// files matched by the .dockerignore file. The .git directory is never part
+// of the context, and the Dockerfile always is.
+func writeBuildContext(dir string, w io.Writer) error {
+	ignore, err := readDockerignore(dir)
+	if err != nil {
+		return err
+	}
+	// The match results of the directories walked so far, which their
+	// children are matched against
+	parents := map[string]patternmatcher.MatchInfo{}
+
+	tw := tar.NewWriter(w)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() && rel == ".git" {
+			return filepath.SkipDir
+		}
+		if ignore != nil && rel != "Dockerfile" && rel != ".dockerignore" {
+			ignored, info, err := ignore.MatchesUsingParentResults(rel, parents[filepath.Dir(rel)])
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				parents[rel] = info
+			}
+			if ignored {
+				// An exception may still include something in the directory
+				if d.IsDir() && !ignore.Exclusions() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+type buildMessage struct {
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux struct {
+		ID string `json:"ID"`
+	} `json:"aux"`
+}
+
+// Build an image from the Dockerfile in contextDir, tagging it with each of
+// tags. The build output is written to output. The id of the built image is
+// returned.
+func BuildImage(ctx context.Context, contextDir string, tags []string, output io.Writer) (string, error) {
+	query := url.Values{}
+	for _, tag := range tags {
+		query.Add("t", tag)
+	}
+	query.Set("rm", "1")
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBuildContext(contextDir, writer))
+	}()
+	defer reader.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", "http://localhost/build?"+query.Encode(), reader)
+	req.Header.Set("Content-Type", "application/x-tar")
+	resp, err := dockerExec(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", responseError(resp)
+	}
+
+	imageId := ""
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg buildMessage
+		err := decoder.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if msg.Error != "" {
+			message := msg.ErrorDetail.Message
+			if message == "" {
+				message = msg.Error
+			}
+			return "", &APIError{
+				StatusCode: resp.StatusCode,
+				Message:    message,
+			}
+		}
+		if msg.Stream != "" && output != nil {
+			io.WriteString(output, msg.Stream)
+		}
+		if msg.Aux.ID != "" {
+			imageId = msg.Aux.ID
+		}
+	}
+
+	if imageId == "" {
+		return "", errors.New("The build did not produce an image")
+	}
+	return imageId, nil
+}
@@ -1,12 +1,17 @@
 package docker
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -15,31 +20,107 @@ import (
 
 var ErrorNotRegistered = errors.New("Container not registered")
 var ErrorDoesNotExist = errors.New("Container does not exist")
+var ErrorConflict = errors.New("Conflict with the current state")
+
+// An error returned by the docker engine that has no dedicated error value
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Returned Status Code %v", e.StatusCode)
+	}
+	return fmt.Sprintf("Returned Status Code %v: %v", e.StatusCode, e.Message)
+}
+
+// Convert an unsuccessful response into an error
+func responseError(resp *http.Response) error {
+	if resp.StatusCode == 404 {
+		return ErrorDoesNotExist
+	}
+	if resp.StatusCode == 409 {
+		return ErrorConflict
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(raw, &body); err != nil {
+		body.Message = strings.TrimSpace(string(raw))
+	}
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    body.Message,
+	}
+}
 
 func RepoNameToContainerName(repoName string) string {
 	return "bs-" + strings.ReplaceAll(repoName, "/", "-")
 }
 
+// The image repository that a repo's images are tagged in. Docker only
+// allows lowercase repository names.
+func RepoNameToImageRepo(repoName string) string {
+	return strings.ToLower(repoName)
+}
+
+// The tag of the image that the container is currently created from
+func RepoNameToImage(repoName string) string {
+	return RepoNameToImageRepo(repoName) + ":local"
+}
+
+// The tag of the image built from a specific commit
+func RepoNameToCommitImage(repoName string, sha string) string {
+	return RepoNameToImageRepo(repoName) + ":" + sha
+}
+
 var client *http.Client = nil
 var clientMutex sync.Mutex
 
-const socketPath string = "/var/run/docker.sock"
+var socketPath string = "/var/run/docker.sock"
 
-func dockerExec(req *http.Request) (*http.Response, error) {
+// Talk to a docker engine listening on a different unix socket
+func SetSocketPath(path string) {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	socketPath = path
+	client = nil
+}
+
+func getClient() *http.Client {
 	clientMutex.Lock()
 	defer clientMutex.Unlock()
 	if client == nil {
+		path := socketPath
 		tr := &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return net.Dial("unix", socketPath)
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
 			},
 		}
 		client = &http.Client{
 			Transport: tr,
 		}
 	}
+	return client
+}
+
+func dockerExec(req *http.Request) (*http.Response, error) {
+	return getClient().Do(req)
+}
 
-	return client.Do(req)
+func dockerExecJsonBody(req *http.Request, body any, result any) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(raw))
+	req.ContentLength = int64(len(raw))
+	req.Header.Set("Content-Type", "application/json")
+	return dockerExecJson(req, result)
 }
 
 func dockerExecJson(req *http.Request, result any) error {
@@ -49,11 +130,11 @@ func dockerExecJson(req *http.Request, result any) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 {
-		return ErrorDoesNotExist
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return responseError(resp)
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Returned Status Code %v", resp.StatusCode)
+	if result == nil {
+		return nil
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
@@ -73,10 +154,7 @@ func dockerExecCmd(container string, action string) error {
 	if resp.StatusCode == 204 || resp.StatusCode == 304 {
 		return nil
 	}
-	if resp.StatusCode == 404 {
-		return ErrorDoesNotExist
-	}
-	return fmt.Errorf("Returned Status Code %v", resp.StatusCode)
+	return responseError(resp)
 }
 
 func WaitForDockerSocket() {
@@ -95,7 +173,7 @@ func WaitForDockerSocket() {
 
 		if time.Since(lastLog) > 5*time.Second {
 			lastLog = time.Now()
-			fmt.Printf("docker socket not available after %d seconds\n", int(time.Since(start).Seconds()))
+			slog.Warn("docker socket not available", "socket", socketPath, "waited", time.Since(start).Round(time.Second))
 		}
 
 		time.Sleep(500 * time.Millisecond)
@@ -106,6 +184,9 @@ type ContainerStateJson struct {
 	State struct {
 		Running bool `json:"Running"`
 		Paused  bool `json:"Paused"`
+		Health  *struct {
+			Status string `json:"Status"`
+		} `json:"Health"`
 	} `json:"State"`
 	NetworkSettings struct {
 		IPAddress string `json:"IPAdress"`
@@ -115,28 +196,55 @@ type ContainerStateJson struct {
 	} `json:"NetworkSettings"`
 }
 
-func CheckContainer(name string) (bool, error) {
-	if !IsRegistered(name) {
-		return false, ErrorNotRegistered
-	}
-	req, _ := http.NewRequest("GET", "http://localhost/containers/"+name+"/json", nil)
-	var result ContainerStateJson
-	err := dockerExecJson(req, &result)
-	if err != nil {
-		return false, err
+// Find the container's ip address, preferring the given network
+func (r ContainerStateJson) ipAddress(network string) string {
+	ip := r.NetworkSettings.IPAddress
+	if network != "" {
+		if settings, found := r.NetworkSettings.Networks[network]; found && settings.IPAdress != "" {
+			ip = settings.IPAdress
+		}
 	}
-
-	ip := result.NetworkSettings.IPAddress
 	if ip == "" {
-		for _, v := range result.NetworkSettings.Networks {
+		for _, v := range r.NetworkSettings.Networks {
 			if v.IPAdress != "" {
 				ip = v.IPAdress
 				break
 			}
 		}
 	}
+	return ip
+}
+
+// The status of the image's HEALTHCHECK, empty if it does not define one
+func (r ContainerStateJson) health() string {
+	if r.State.Health == nil {
+		return ""
+	}
+	return r.State.Health.Status
+}
+
+func inspectContainer(name string) (ContainerStateJson, error) {
+	req, _ := http.NewRequest("GET", "http://localhost/containers/"+name+"/json", nil)
+	var result ContainerStateJson
+	err := dockerExecJson(req, &result)
+	return result, err
+}
 
-	err = updateState(name, result.State.Running, result.State.Paused, ip)
+func CheckContainer(name string) (bool, error) {
+	state, err := GetState(name)
+	if err != nil {
+		return false, err
+	}
+	result, err := inspectContainer(name)
+	if err == ErrorDoesNotExist {
+		updateMissing(name)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ip := result.ipAddress(state.Options.Network)
+	err = updateState(name, result.State.Running, result.State.Paused, ip, result.health())
 	if err != nil {
 		return false, err
 	}
@@ -144,76 +252,191 @@ func CheckContainer(name string) (bool, error) {
 	return result.State.Running && !result.State.Paused, nil
 }
 
-func EnsureContainerRunning(name string) error {
-	if IsStale(name) {
-		_, err := CheckContainer(name)
-		if err != nil {
-			return err
-		}
-	}
-
+func EnsureContainerRunning(ctx context.Context, name string) error {
 	state, err := GetState(name)
 	if err != nil {
 		return err
 	}
+	if state.isStale(time.Now()) {
+		if state.Exists && state.Running && !state.Paused {
+			// A running container rarely changes on its own, so the request
+			// does not wait for docker
+			refreshInBackground(name)
+		} else {
+			_, err := CheckContainer(name)
+			if err == ErrorDoesNotExist {
+				// The container was removed while idle, recreate it from its image
+				coldStartsMetric.Inc(name)
+				return recreateContainer(ctx, name)
+			}
+			if err != nil {
+				return err
+			}
+			state, err = GetState(name)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
+	if !state.Exists {
+		coldStartsMetric.Inc(name)
+		return recreateContainer(ctx, name)
+	}
 	if state.Running && state.Paused {
-		return UnpauseContainer(name)
+		return UnpauseContainer(ctx, name)
 	}
 	if !state.Running {
-		return StartContainer(name)
+		coldStartsMetric.Inc(name)
+		return StartContainer(ctx, name)
 	}
 	return nil
 }
 
-func StartContainer(name string) error {
+func recreateContainer(ctx context.Context, name string) error {
+	state, err := GetState(name)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Recreating container", "container", name, "image", state.Image)
+	_, err = CreateContainer(name, state.Image, state.Options)
+	if err != nil {
+		return err
+	}
+	return StartContainer(ctx, name)
+}
+
+func StartContainer(ctx context.Context, name string) error {
 	if !IsRegistered(name) {
 		return ErrorNotRegistered
 	}
-	fmt.Printf("Starting %v\n", name)
+	slog.InfoContext(ctx, "Starting container", "container", name)
 	err := dockerExecCmd(name, "start")
 	if err != nil {
 		return err
 	}
+	updateReady(name, false)
 
 	// Force update the ip
 	_, err = CheckContainer(name)
 	return err
 }
 
-func StopContainer(name string) error {
+// Create a new container from an image, returning its id
+func CreateContainer(name string, image string, options RunOptions) (string, error) {
+	req, _ := http.NewRequest("POST", "http://localhost/containers/create?name="+url.QueryEscape(name), nil)
+	body := options.createBody(image)
+	var result struct {
+		Id string `json:"Id"`
+	}
+	err := dockerExecJsonBody(req, body, &result)
+	if err != nil {
+		return "", err
+	}
+	return result.Id, nil
+}
+
+// Delete a container. If force is set, the container will be killed first
+// if it is running.
+func RemoveContainer(name string, force bool) error {
+	expectExit(name)
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("http://localhost/containers/%v?force=%v", name, force), nil)
+	resp, err := dockerExec(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 204 {
+		return responseError(resp)
+	}
+	if IsRegistered(name) {
+		return updateMissing(name)
+	}
+	return nil
+}
+
+func RenameContainer(name string, newName string) error {
+	req, _ := http.NewRequest("POST", "http://localhost/containers/"+name+"/rename?name="+url.QueryEscape(newName), nil)
+	resp, err := dockerExec(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 204 {
+		return nil
+	}
+	return responseError(resp)
+}
+
+func StopContainer(ctx context.Context, name string) error {
 	if !IsRegistered(name) {
 		return ErrorNotRegistered
 	}
-	fmt.Printf("Stopping %v\n", name)
+	slog.InfoContext(ctx, "Stopping container", "container", name)
+	expectExit(name)
 	err := dockerExecCmd(name, "stop")
 	if err != nil {
 		return err
 	}
+	stopsMetric.Inc(name)
 
 	return updateRunning(name, false, false)
 }
-func PauseContainer(name string) error {
+func PauseContainer(ctx context.Context, name string) error {
 	if !IsRegistered(name) {
 		return ErrorNotRegistered
 	}
-	fmt.Printf("Pausing %v\n", name)
+	slog.InfoContext(ctx, "Pausing container", "container", name)
 	err := dockerExecCmd(name, "pause")
 	if err != nil {
 		return err
 	}
+	pausesMetric.Inc(name)
 
 	return updatePaused(name, true)
 }
-func UnpauseContainer(name string) error {
+func UnpauseContainer(ctx context.Context, name string) error {
 	if !IsRegistered(name) {
 		return ErrorNotRegistered
 	}
-	fmt.Printf("Unpausing %v\n", name)
+	slog.InfoContext(ctx, "Unpausing container", "container", name)
 	err := dockerExecCmd(name, "unpause")
 	if err != nil {
 		return err
 	}
+	unpausesMetric.Inc(name)
+	updateReady(name, false)
 
 	return updatePaused(name, false)
 }
+
+// Write the last tail lines of a container's stdout and stderr to w
+func ContainerLogs(name string, tail int, w io.Writer) error {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost/containers/%v/logs?stdout=1&stderr=1&tail=%v", name, tail), nil)
+	resp, err := dockerExec(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return responseError(resp)
+	}
+
+	// Containers are created without a tty, so stdout and stderr are
+	// multiplexed into frames with an 8 byte header that ends with the
+	// frame's size
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(resp.Body, header)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err = io.CopyN(w, resp.Body, size); err != nil {
+			return err
+		}
+	}
+}
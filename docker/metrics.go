@@ -0,0 +1,62 @@
+package docker
+
+import (
+	"sort"
+
+	"github.com/ttocsneb/battlesnake-manager/metrics"
+)
+
+var coldStartsMetric *metrics.CounterVec = metrics.NewCounterVec(
+	"battlesnake_container_cold_starts_total",
+	"Number of times a request had to start or recreate a stopped container",
+	"snake",
+)
+var unpausesMetric *metrics.CounterVec = metrics.NewCounterVec(
+	"battlesnake_container_unpauses_total",
+	"Number of times a container was unpaused",
+	"snake",
+)
+var pausesMetric *metrics.CounterVec = metrics.NewCounterVec(
+	"battlesnake_container_pauses_total",
+	"Number of times a container was paused",
+	"snake",
+)
+var stopsMetric *metrics.CounterVec = metrics.NewCounterVec(
+	"battlesnake_container_stops_total",
+	"Number of times a container was stopped",
+	"snake",
+)
+
+// Emit a gauge value for each registered container
+func collectStates(value func(state ContainerState) bool) func(emit func(float64, ...string)) {
+	return func(emit func(float64, ...string)) {
+		states := map[string]ContainerState{}
+		names := []string{}
+		IterContainers(func(name string, container ContainerState) bool {
+			states[name] = container
+			names = append(names, name)
+			return true
+		})
+		sort.Strings(names)
+		for _, name := range names {
+			v := 0.0
+			if value(states[name]) {
+				v = 1
+			}
+			emit(v, name)
+		}
+	}
+}
+
+var _ = metrics.NewGaugeFunc(
+	"battlesnake_container_running",
+	"Whether the container is running and not paused",
+	collectStates(func(state ContainerState) bool { return state.Running && !state.Paused }),
+	"snake",
+)
+var _ = metrics.NewGaugeFunc(
+	"battlesnake_container_paused",
+	"Whether the container is paused",
+	collectStates(func(state ContainerState) bool { return state.Running && state.Paused }),
+	"snake",
+)
@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The options used when creating a snake's container
+type RunOptions struct {
+	Env     map[string]string `json:"env"`
+	Memory  string            `json:"memory"`
+	Cpus    float64           `json:"cpus"`
+	Port    int               `json:"port"`
+	Network string            `json:"network"`
+	Restart string            `json:"restart"`
+	// The path polled to check that the snake is ready for requests
+	HealthPath string `json:"health_path"`
+}
+
+func (o RunOptions) GetHealthPath() string {
+	if o.HealthPath == "" {
+		return "/"
+	}
+	return o.HealthPath
+}
+
+// The port the snake listens on
+func (o RunOptions) GetPort() int {
+	if o.Port == 0 {
+		return 80
+	}
+	return o.Port
+}
+
+// Parse a memory size such as `512m` or `1g` into bytes
+func parseMemory(memory string) (int64, error) {
+	if memory == "" {
+		return 0, nil
+	}
+	value := strings.ToLower(strings.TrimSpace(memory))
+	value = strings.TrimSuffix(value, "b")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid memory limit %q, expected a size like 512m or 1g", memory)
+	}
+	return n * multiplier, nil
+}
+
+func parseRestart(restart string) (string, int, error) {
+	name, count, hasCount := strings.Cut(restart, ":")
+	switch name {
+	case "", "no", "always", "unless-stopped":
+		if hasCount {
+			return "", 0, fmt.Errorf("Restart policy %q does not take a retry count", name)
+		}
+		return name, 0, nil
+	case "on-failure":
+		if !hasCount {
+			return name, 0, nil
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return "", 0, fmt.Errorf("Invalid retry count %q in restart policy", count)
+		}
+		return name, n, nil
+	}
+	return "", 0, fmt.Errorf("Unknown restart policy %q, expected no, always, unless-stopped or on-failure[:N]", restart)
+}
+
+func (o RunOptions) Validate() error {
+	for k := range o.Env {
+		if k == "" || strings.ContainsAny(k, "= \t\n") {
+			return fmt.Errorf("Invalid environment variable name %q", k)
+		}
+	}
+	if _, err := parseMemory(o.Memory); err != nil {
+		return err
+	}
+	if o.Cpus < 0 {
+		return fmt.Errorf("Invalid cpu limit %v, must not be negative", o.Cpus)
+	}
+	if o.Port < 0 || o.Port > 65535 {
+		return fmt.Errorf("Invalid port %v", o.Port)
+	}
+	if strings.ContainsAny(o.Network, " \t\n/") {
+		return fmt.Errorf("Invalid network name %q", o.Network)
+	}
+	if _, _, err := parseRestart(o.Restart); err != nil {
+		return err
+	}
+	if o.HealthPath != "" && !strings.HasPrefix(o.HealthPath, "/") {
+		return fmt.Errorf("Invalid health path %q, must start with /", o.HealthPath)
+	}
+	return nil
+}
+
+// Build the body of a container create request
+func (o RunOptions) createBody(image string) map[string]any {
+	env := []string{}
+	for k, v := range o.Env {
+		env = append(env, k+"="+v)
+	}
+	slices.Sort(env)
+
+	hostConfig := map[string]any{}
+	if memory, _ := parseMemory(o.Memory); memory > 0 {
+		hostConfig["Memory"] = memory
+	}
+	if o.Cpus > 0 {
+		hostConfig["NanoCpus"] = int64(o.Cpus * 1e9)
+	}
+	if o.Network != "" {
+		hostConfig["NetworkMode"] = o.Network
+	}
+	if name, count, _ := parseRestart(o.Restart); name != "" {
+		hostConfig["RestartPolicy"] = map[string]any{
+			"Name":              name,
+			"MaximumRetryCount": count,
+		}
+	}
+
+	return map[string]any{
+		"Image":        image,
+		"Env":          env,
+		"ExposedPorts": map[string]any{fmt.Sprintf("%v/tcp", o.GetPort()): map[string]any{}},
+		"HostConfig":   hostConfig,
+	}
+}
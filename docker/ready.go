@@ -0,0 +1,83 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var ErrorNotReady = errors.New("Container is not ready")
+
+var probeClient *http.Client = &http.Client{}
+
+// Check once whether the snake answers http requests
+func probeContainer(ctx context.Context, state ContainerState) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+state.Address()+state.Options.GetHealthPath(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// Wait until the snake is able to respond to requests. If the image defines a
+// HEALTHCHECK, a healthy status makes the snake ready. Since the first check
+// may only run after the HEALTHCHECK's interval, a snake that is still
+// starting is also ready once its health path answers, as is a snake without
+// a HEALTHCHECK. ErrorNotReady is returned if the snake is not ready before
+// ctx is done.
+func WaitReady(ctx context.Context, name string) error {
+	delay := 10 * time.Millisecond
+	for {
+		state, err := GetState(name)
+		if err != nil {
+			return err
+		}
+		if state.Ready {
+			return nil
+		}
+
+		ready := false
+		if state.Health != "" {
+			_, err = CheckContainer(name)
+			if err != nil {
+				return err
+			}
+			state, err = GetState(name)
+			if err != nil {
+				return err
+			}
+			ready = state.Health == "healthy"
+		}
+		if !ready && state.Health != "unhealthy" && state.Running && !state.Paused {
+			ready = probeContainer(ctx, state)
+		}
+		if ready {
+			return updateReady(name, true)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrorNotReady
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 500*time.Millisecond)
+	}
+}
+
+// Make sure the container is running and ready to accept requests
+func EnsureContainerReady(ctx context.Context, name string) error {
+	err := EnsureContainerRunning(ctx, name)
+	if err != nil {
+		return err
+	}
+	return WaitReady(ctx, name)
+}
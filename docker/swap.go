@@ -0,0 +1,199 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// How long a new container has to become ready during a swap
+const candidateReadyTimeout time.Duration = 2 * time.Minute
+
+// How many lines of a failed candidate container's output to keep
+const candidateLogLines int = 200
+
+// How long to wait for requests to the old container to finish during a swap
+const drainTimeout time.Duration = 30 * time.Second
+
+// The number of requests currently being sent to each address
+var inflight map[string]int = map[string]int{}
+var inflightMutex sync.Mutex
+
+// Record that a request is being sent to addr. The returned function must be
+// called once the request has finished.
+func BeginRequest(addr string) func() {
+	inflightMutex.Lock()
+	inflight[addr]++
+	inflightMutex.Unlock()
+
+	return func() {
+		inflightMutex.Lock()
+		defer inflightMutex.Unlock()
+
+		inflight[addr]--
+		if inflight[addr] <= 0 {
+			delete(inflight, addr)
+		}
+	}
+}
+
+func inflightRequests(addr string) int {
+	inflightMutex.Lock()
+	defer inflightMutex.Unlock()
+
+	return inflight[addr]
+}
+
+// Wait for a freshly started container to answer requests
+func waitCandidateReady(ctx context.Context, name string, options RunOptions) (ContainerStateJson, error) {
+	ctx, cancel := context.WithTimeout(ctx, candidateReadyTimeout)
+	defer cancel()
+
+	delay := 100 * time.Millisecond
+	for {
+		result, err := inspectContainer(name)
+		if err != nil {
+			return result, err
+		}
+		if !result.State.Running {
+			return result, errors.New("The container exited before it became ready")
+		}
+		switch result.health() {
+		case "healthy":
+			return result, nil
+		case "unhealthy":
+			return result, errors.New("The container's health check failed")
+		default:
+			// Without a HEALTHCHECK, or before its first check
+			probe := ContainerState{
+				IPAddress: result.ipAddress(options.Network),
+				Options:   options,
+			}
+			if probeContainer(ctx, probe) {
+				return result, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ErrorNotReady
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 2*time.Second)
+	}
+}
+
+// Point a registered container's state at a freshly started container
+func switchState(name string, result ContainerStateJson) error {
+	containerStateMutext.Lock()
+	defer containerStateMutext.Unlock()
+
+	state, found := containerStates[name]
+	if !found {
+		return ErrorNotRegistered
+	}
+	state.Running = true
+	state.Paused = false
+	state.Exists = true
+	state.Ready = true
+	state.IPAddress = result.ipAddress(state.Options.Network)
+	state.Health = result.health()
+	state.clock.updated.Store(time.Now().UnixNano())
+	saveStateUnsafe(name, state)
+
+	return nil
+}
+
+// Replace a registered container with a new one created from image without
+// downtime. The new container is started under a temporary name and must
+// become ready before requests are switched over to it. The old container is
+// then drained and removed. If the new container fails to start, the old one
+// is left untouched and the new container's last output is written to output.
+func SwapContainer(ctx context.Context, name string, image string, output io.Writer) error {
+	state, err := GetState(name)
+	if err != nil {
+		return err
+	}
+	candidate := name + "-next"
+	retired := name + "-old"
+
+	// Clean up after a previous swap that did not finish
+	for _, leftover := range []string{candidate, retired} {
+		err = RemoveContainer(leftover, true)
+		if err != nil && err != ErrorDoesNotExist {
+			return fmt.Errorf("Could not remove leftover container %v: %w", leftover, err)
+		}
+	}
+
+	slog.InfoContext(ctx, "Starting candidate container", "container", candidate, "image", image)
+	_, err = CreateContainer(candidate, image, state.Options)
+	if err != nil {
+		return err
+	}
+	discard := func() {
+		if err := RemoveContainer(candidate, true); err != nil {
+			slog.ErrorContext(ctx, "Could not remove candidate container", "container", candidate, "error", err)
+		}
+	}
+	if err = dockerExecCmd(candidate, "start"); err != nil {
+		discard()
+		return err
+	}
+	result, err := waitCandidateReady(ctx, candidate, state.Options)
+	if err != nil {
+		if output != nil {
+			fmt.Fprintf(output, "==> Last output of %v\n", candidate)
+			if err := ContainerLogs(candidate, candidateLogLines, output); err != nil {
+				slog.ErrorContext(ctx, "Could not get the candidate container's logs", "container", candidate, "error", err)
+			}
+		}
+		discard()
+		return err
+	}
+
+	// Refresh the state of the old container in case it changed since the
+	// swap started
+	_, err = CheckContainer(name)
+	if err != nil && err != ErrorDoesNotExist {
+		discard()
+		return err
+	}
+	old, _ := GetState(name)
+
+	if old.Exists {
+		if err = RenameContainer(name, retired); err != nil {
+			discard()
+			return err
+		}
+	}
+	if err = RenameContainer(candidate, name); err != nil {
+		if old.Exists {
+			RenameContainer(retired, name)
+		}
+		discard()
+		return err
+	}
+	if err = switchState(name, result); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Switched to the new container", "container", name)
+
+	if !old.Exists {
+		return nil
+	}
+
+	// Let any requests that were already sent to the old container finish
+	if old.Running && !old.Paused {
+		oldAddr := old.Address()
+		deadline := time.Now().Add(drainTimeout)
+		for inflightRequests(oldAddr) > 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	slog.InfoContext(ctx, "Removing the old container", "container", retired)
+	return RemoveContainer(retired, true)
+}
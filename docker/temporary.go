@@ -0,0 +1,44 @@
+package docker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"strconv"
+)
+
+// Start a throwaway container from image with the run options of the
+// registered container name, and wait for it to become ready. Returns the
+// address it can be reached at and a function that removes it again.
+func StartTemporaryContainer(ctx context.Context, name string, image string) (string, func(), error) {
+	state, err := GetState(name)
+	if err != nil {
+		return "", nil, err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	temporary := name + "-tmp-" + hex.EncodeToString(suffix)
+
+	slog.InfoContext(ctx, "Starting temporary container", "container", temporary, "image", image)
+	if _, err = CreateContainer(temporary, image, state.Options); err != nil {
+		return "", nil, err
+	}
+	remove := func() {
+		if err := RemoveContainer(temporary, true); err != nil {
+			slog.ErrorContext(ctx, "Could not remove temporary container", "container", temporary, "error", err)
+		}
+	}
+	if err = dockerExecCmd(temporary, "start"); err != nil {
+		remove()
+		return "", nil, err
+	}
+	result, err := waitCandidateReady(ctx, temporary, state.Options)
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	addr := net.JoinHostPort(result.ipAddress(state.Options.Network), strconv.Itoa(state.Options.GetPort()))
+	return addr, remove, nil
+}
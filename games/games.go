@@ -0,0 +1,427 @@
+package games
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where recorded games are written, as <snake>/<game id>.jsonl.gz
+const Dir string = "/data/games"
+
+const fileSuffix string = ".jsonl.gz"
+
+// Games that are still being recorded have this added to their file name
+const partialSuffix string = ".part"
+
+// How many games are kept for each snake when not configured
+const defaultKeepGames int = 200
+
+// How long a game may go without requests before its recording is closed
+const abandonedAfter time.Duration = 5 * time.Minute
+
+// The kinds of records in a game
+const (
+	RecordStart = "start"
+	RecordMove  = "move"
+	RecordEnd   = "end"
+)
+
+var ErrorNotFound = errors.New("Game not found")
+
+// Requests that arrive after a game's end are not recorded
+var errFinished = errors.New("The game has already been recorded")
+
+var gameIdPattern *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// Whether and how long games are recorded for a snake
+type Settings struct {
+	Enabled bool `json:"enabled"`
+	// How many games to keep, 200 if not set
+	KeepGames int `json:"keep_games"`
+	// Delete games older than this many days, never if not set
+	KeepDays int `json:"keep_days"`
+}
+
+func (s Settings) Validate() error {
+	if s.KeepGames < 0 {
+		return errors.New("keep_games must not be negative")
+	}
+	if s.KeepDays < 0 {
+		return errors.New("keep_days must not be negative")
+	}
+	return nil
+}
+
+// One request of a game and the snake's response
+type Record struct {
+	Type      string          `json:"type"`
+	Time      time.Time       `json:"time"`
+	Turn      int             `json:"turn"`
+	Status    int             `json:"status,omitempty"`
+	LatencyMs float64         `json:"latency_ms"`
+	Request   json.RawMessage `json:"request,omitempty"`
+	Response  json.RawMessage `json:"response,omitempty"`
+	// The manager answered for the snake because it failed or was too slow
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// A game that is being recorded
+type recording struct {
+	mutex    sync.Mutex
+	path     string
+	file     *os.File
+	gz       *gzip.Writer
+	encoder  *json.Encoder
+	lastSeen time.Time
+}
+
+// The games being recorded, keyed by snake and then game id
+var recordings map[string]map[string]*recording = map[string]map[string]*recording{}
+var recordingsMutex sync.Mutex
+var sweepOnce sync.Once
+
+// Convert a response body into something that can be embedded in a record
+func Body(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	raw, _ := json.Marshal(string(body))
+	return raw
+}
+
+func snakeDir(snake string) string {
+	return filepath.Join(Dir, strings.TrimPrefix(snake, "bs-"))
+}
+
+func gamePath(snake string, gameId string) string {
+	return filepath.Join(snakeDir(snake), gameId+fileSuffix)
+}
+
+func open(snake string, gameId string) (*recording, error) {
+	recordingsMutex.Lock()
+	defer recordingsMutex.Unlock()
+
+	games, found := recordings[snake]
+	if !found {
+		games = map[string]*recording{}
+		recordings[snake] = games
+	}
+	if rec, found := games[gameId]; found {
+		return rec, nil
+	}
+
+	if err := os.MkdirAll(snakeDir(snake), 0o750); err != nil {
+		return nil, err
+	}
+	path := gamePath(snake, gameId)
+	if _, err := os.Stat(path); err == nil {
+		return nil, errFinished
+	}
+	file, err := os.OpenFile(path+partialSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(file)
+	rec := &recording{
+		path:     path,
+		file:     file,
+		gz:       gz,
+		encoder:  json.NewEncoder(gz),
+		lastSeen: time.Now(),
+	}
+	games[gameId] = rec
+
+	sweepOnce.Do(func() {
+		go sweepAbandoned()
+	})
+	return rec, nil
+}
+
+// Close a recording and move it to its final name
+func (rec *recording) close() error {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	if rec.file == nil {
+		return nil
+	}
+	err := rec.gz.Close()
+	if closeErr := rec.file.Close(); err == nil {
+		err = closeErr
+	}
+	rec.file = nil
+	if err != nil {
+		return err
+	}
+	return os.Rename(rec.path+partialSuffix, rec.path)
+}
+
+func forget(snake string, gameId string) *recording {
+	recordingsMutex.Lock()
+	defer recordingsMutex.Unlock()
+
+	rec := recordings[snake][gameId]
+	delete(recordings[snake], gameId)
+	if len(recordings[snake]) == 0 {
+		delete(recordings, snake)
+	}
+	return rec
+}
+
+// How many records may wait for the writer before new ones are dropped
+const maxQueuedRecords int = 1024
+
+type queuedRecord struct {
+	snake    string
+	gameId   string
+	settings Settings
+	record   Record
+	// Closed once everything queued before it has been written
+	flushed chan struct{}
+}
+
+// Records are encoded and written by a single goroutine so that the proxy
+// does not wait for them and a game's records stay in order
+var queue chan queuedRecord = make(chan queuedRecord, maxQueuedRecords)
+var writerOnce sync.Once
+
+// Add a record to a snake's game in the background. The recording is
+// finished once the end record is written.
+func Write(snake string, gameId string, settings Settings, record Record) {
+	if !settings.Enabled || !gameIdPattern.MatchString(gameId) {
+		return
+	}
+	writerOnce.Do(func() {
+		go writeQueued()
+	})
+	select {
+	case queue <- queuedRecord{snake: snake, gameId: gameId, settings: settings, record: record}:
+	default:
+		slog.Error("Could not record game, too many records are waiting to be written", "snake", snake, "game_id", gameId)
+	}
+}
+
+func writeQueued() {
+	for queued := range queue {
+		if queued.flushed != nil {
+			close(queued.flushed)
+			continue
+		}
+		write(queued.snake, queued.gameId, queued.settings, queued.record)
+	}
+}
+
+// Wait until the records queued so far have been written
+func flush() {
+	flushed := make(chan struct{})
+	writerOnce.Do(func() {
+		go writeQueued()
+	})
+	queue <- queuedRecord{flushed: flushed}
+	<-flushed
+}
+
+func write(snake string, gameId string, settings Settings, record Record) {
+	rec, err := open(snake, gameId)
+	if err == errFinished {
+		return
+	}
+	if err != nil {
+		slog.Error("Could not record game", "snake", snake, "game_id", gameId, "error", err)
+		return
+	}
+
+	rec.mutex.Lock()
+	if rec.file != nil {
+		err = rec.encoder.Encode(record)
+		rec.lastSeen = time.Now()
+	}
+	rec.mutex.Unlock()
+	if err != nil {
+		slog.Error("Could not record game", "snake", snake, "game_id", gameId, "error", err)
+	}
+
+	if record.Type != RecordEnd {
+		return
+	}
+	if rec := forget(snake, gameId); rec != nil {
+		if err := rec.close(); err != nil {
+			slog.Error("Could not finish recording game", "snake", snake, "game_id", gameId, "error", err)
+		}
+	}
+	prune(snake, settings)
+}
+
+// Finish the recordings of games that the engine stopped talking about
+func sweepAbandoned() {
+	for {
+		time.Sleep(time.Minute)
+
+		type abandoned struct {
+			snake  string
+			gameId string
+		}
+		stale := []abandoned{}
+		now := time.Now()
+		recordingsMutex.Lock()
+		for snake, games := range recordings {
+			for gameId, rec := range games {
+				rec.mutex.Lock()
+				if now.Sub(rec.lastSeen) > abandonedAfter {
+					stale = append(stale, abandoned{snake, gameId})
+				}
+				rec.mutex.Unlock()
+			}
+		}
+		recordingsMutex.Unlock()
+
+		for _, game := range stale {
+			if rec := forget(game.snake, game.gameId); rec != nil {
+				slog.Info("Finished recording abandoned game", "snake", game.snake, "game_id", game.gameId)
+				if err := rec.close(); err != nil {
+					slog.Error("Could not finish recording game", "snake", game.snake, "game_id", game.gameId, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// A recorded game
+type Summary struct {
+	ID       string    `json:"id"`
+	Size     int64     `json:"size"`
+	Finished time.Time `json:"finished"`
+}
+
+// List a snake's finished games, newest first
+func List(snake string) ([]Summary, error) {
+	entries, err := os.ReadDir(snakeDir(snake))
+	if os.IsNotExist(err) {
+		return []Summary{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Summary{}
+	for _, entry := range entries {
+		gameId, found := strings.CutSuffix(entry.Name(), fileSuffix)
+		if !found || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		result = append(result, Summary{
+			ID:       gameId,
+			Size:     info.Size(),
+			Finished: info.ModTime(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Finished.After(result[j].Finished)
+	})
+	return result, nil
+}
+
+// The path of a finished game's recording
+func Path(snake string, gameId string) (string, error) {
+	if !gameIdPattern.MatchString(gameId) {
+		return "", ErrorNotFound
+	}
+	path := gamePath(snake, gameId)
+	if _, err := os.Stat(path); err != nil {
+		return "", ErrorNotFound
+	}
+	return path, nil
+}
+
+// Delete the games that are past the snake's retention limits
+func prune(snake string, settings Settings) {
+	keep := settings.KeepGames
+	if keep <= 0 {
+		keep = defaultKeepGames
+	}
+	games, err := List(snake)
+	if err != nil {
+		slog.Error("Could not list recorded games", "snake", snake, "error", err)
+		return
+	}
+	cutoff := time.Time{}
+	if settings.KeepDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -settings.KeepDays)
+	}
+	for i, game := range games {
+		if i < keep && game.Finished.After(cutoff) {
+			continue
+		}
+		if err := os.Remove(gamePath(snake, game.ID)); err != nil && !os.IsNotExist(err) {
+			slog.Error("Could not remove old game", "snake", snake, "game_id", game.ID, "error", err)
+		}
+	}
+}
+
+// Finish every recording, used when the manager shuts down
+func CloseAll() {
+	flush()
+
+	recordingsMutex.Lock()
+	open := recordings
+	recordings = map[string]map[string]*recording{}
+	recordingsMutex.Unlock()
+
+	for snake, games := range open {
+		for gameId, rec := range games {
+			if err := rec.close(); err != nil {
+				slog.Error("Could not finish recording game", "snake", snake, "game_id", gameId, "error", err)
+			}
+		}
+	}
+}
+
+// Read the records of a finished game
+func Read(snake string, gameId string) ([]Record, error) {
+	path, err := Path(snake, gameId)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	records := []Record{}
+	decoder := json.NewDecoder(gz)
+	for {
+		var record Record
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
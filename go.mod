@@ -2,4 +2,6 @@ module github.com/ttocsneb/battlesnake-manager
 
 go 1.22.3
 
-require github.com/gorilla/mux v1.8.1 // indirect
+require github.com/gorilla/mux v1.8.1
+
+require github.com/moby/patternmatcher v0.6.0
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A duration in the config file such as "5m" or "1h30m". "never" or "0"
+// disables the action.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return fmt.Errorf("Invalid duration %v, expected a string like \"5m\"", string(b))
+	}
+	if value == "never" || value == "0" {
+		d.Duration = 0
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %q: %w", value, err)
+	}
+	if parsed < 0 {
+		return fmt.Errorf("Invalid duration %q, must not be negative", value)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+var weekdays map[string]time.Weekday = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// A time window during which a snake is kept running. From and To are
+// formatted as 15:04 in local time. If To is before From, the window ends on
+// the next day.
+type KeepWarmWindow struct {
+	Days []string `json:"days"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w KeepWarmWindow) Validate() error {
+	for _, day := range w.Days {
+		if _, found := weekdays[strings.ToLower(day)]; !found {
+			return fmt.Errorf("Invalid day %q, expected one of sun, mon, tue, wed, thu, fri, sat", day)
+		}
+	}
+	if _, err := parseClock(w.From); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.To); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (w KeepWarmWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether now is within the window, and if so how long until it closes
+func (w KeepWarmWindow) Active(now time.Time) (bool, time.Duration) {
+	from, _ := parseClock(w.From)
+	to, _ := parseClock(w.To)
+	minutes := now.Hour()*60 + now.Minute()
+	untilMinute := func(m int) time.Duration {
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		end := midnight.Add(time.Duration(m) * time.Minute)
+		if !end.After(now) {
+			end = end.Add(24 * time.Hour)
+		}
+		return end.Sub(now)
+	}
+
+	if from <= to {
+		if minutes >= from && minutes < to && w.onDay(now.Weekday()) {
+			return true, untilMinute(to)
+		}
+		return false, 0
+	}
+	// The window wraps around midnight
+	if minutes >= from && w.onDay(now.Weekday()) {
+		return true, untilMinute(to)
+	}
+	if minutes < to && w.onDay(now.AddDate(0, 0, -1).Weekday()) {
+		return true, untilMinute(to)
+	}
+	return false, 0
+}
+
+// How long a snake may sit idle before it is paused, stopped or removed.
+// Unset fields fall back to the global default policy.
+type IdlePolicy struct {
+	PauseAfter  *Duration        `json:"pause_after"`
+	StopAfter   *Duration        `json:"stop_after"`
+	RemoveAfter *Duration        `json:"remove_after"`
+	NeverIdle   *bool            `json:"never_idle"`
+	KeepWarm    []KeepWarmWindow `json:"keep_warm"`
+}
+
+var builtinIdlePolicy IdlePolicy = IdlePolicy{
+	PauseAfter:  &Duration{time.Minute},
+	StopAfter:   &Duration{time.Hour},
+	RemoveAfter: &Duration{0},
+	NeverIdle:   new(bool),
+}
+
+func (p IdlePolicy) Validate() error {
+	for _, w := range p.KeepWarm {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("keep_warm: %w", err)
+		}
+	}
+	return nil
+}
+
+// Fill any unset fields of the policy from defaults
+func (p IdlePolicy) WithDefaults(defaults IdlePolicy) IdlePolicy {
+	if p.PauseAfter == nil {
+		p.PauseAfter = defaults.PauseAfter
+	}
+	if p.StopAfter == nil {
+		p.StopAfter = defaults.StopAfter
+	}
+	if p.RemoveAfter == nil {
+		p.RemoveAfter = defaults.RemoveAfter
+	}
+	if p.NeverIdle == nil {
+		p.NeverIdle = defaults.NeverIdle
+	}
+	if p.KeepWarm == nil {
+		p.KeepWarm = defaults.KeepWarm
+	}
+	return p
+}
+
+// Check whether any keep-warm window is currently open, and if so how long
+// until the last one closes
+func (p IdlePolicy) KeepingWarm(now time.Time) (bool, time.Duration) {
+	warm := false
+	var remaining time.Duration
+	for _, w := range p.KeepWarm {
+		if active, left := w.Active(now); active {
+			warm = true
+			remaining = max(remaining, left)
+		}
+	}
+	return warm, remaining
+}
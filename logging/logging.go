@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type Settings struct {
+	// Either "text" or "json"
+	Format string `json:"format"`
+	// One of "debug", "info", "warn" or "error"
+	Level string `json:"level"`
+}
+
+func parseLevel(level string) (slog.Level, error) {
+	var result slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := result.UnmarshalText([]byte(level)); err != nil {
+		return result, fmt.Errorf("Unknown log level %q", level)
+	}
+	return result, nil
+}
+
+func (s Settings) Validate() error {
+	switch strings.ToLower(s.Format) {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("Unknown log format %q, expected text or json", s.Format)
+	}
+	_, err := parseLevel(s.Level)
+	return err
+}
+
+// Replace the default logger with one that follows the settings
+func Setup(settings Settings) error {
+	return SetupWriter(settings, os.Stdout)
+}
+
+func SetupWriter(settings Settings, w io.Writer) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	level, _ := parseLevel(settings.Level)
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.ToLower(settings.Format) == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+type attrsKey struct{}
+
+// Attach attributes to ctx that are added to every line logged with it
+func With(ctx context.Context, args ...any) context.Context {
+	attrs := append([]slog.Attr(nil), Attrs(ctx)...)
+	record := slog.Record{}
+	record.Add(args...)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// Get the attributes attached to ctx with With
+func Attrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// A handler that adds the attributes attached to the context to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs := Attrs(ctx); len(attrs) > 0 {
+		record = record.Clone()
+		record.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Generate a short random id for correlating log lines
+func NewID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -1,106 +1,211 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
+	"context"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/ttocsneb/battlesnake-manager/api"
 	"github.com/ttocsneb/battlesnake-manager/docker"
+	"github.com/ttocsneb/battlesnake-manager/games"
+	"github.com/ttocsneb/battlesnake-manager/logging"
+	"github.com/ttocsneb/battlesnake-manager/notify"
+	"github.com/ttocsneb/battlesnake-manager/store"
 )
 
-type ContainerSetting struct {
-	Name   string `json:"name"`
-	Secret string `json:"secret"`
-}
+const statePath string = "/data/state.json"
 
-func loadConfig() error {
-	body, err := os.ReadFile("/data/battlesnakes.json")
-	if err != nil {
-		// The file could not be read
-		fmt.Println("Could not load battlesnakes settings")
-		fmt.Printf("\t%v\n", err)
-		fmt.Println("\ncontinuing without configuration")
-		return nil
+// Save the state store and finish recording games before the manager is
+// shut down
+func flushOnExit() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	if err := store.Flush(); err != nil {
+		slog.Error("Could not save the state store", "error", err)
 	}
-	var result []ContainerSetting
-	if err = json.NewDecoder(bytes.NewReader(body)).Decode(&result); err != nil {
-		fmt.Println("Could not load battlesnakes settings")
-		fmt.Printf("\t%v\n", err)
-		fmt.Println("\ncontinuing without configuration")
-		return nil
+	games.CloseAll()
+	os.Exit(0)
+}
+
+// Notify about a container that crashed or became unhealthy
+func notifyContainerEvent(event docker.ContainerEvent) {
+	ctx := logging.With(context.Background(), "container", event.Name)
+	switch event.Kind {
+	case docker.ContainerCrashed:
+		slog.WarnContext(ctx, "Container stopped unexpectedly", "reason", event.Reason)
+		notify.Send(ctx, notify.Event{
+			Event: notify.EventContainerCrashed,
+			Snake: event.RepoName,
+			Error: event.Reason,
+		})
+	case docker.ContainerUnhealthy:
+		slog.WarnContext(ctx, "Container is unhealthy")
+		notify.Send(ctx, notify.Event{
+			Event: notify.EventSnakeUnhealthy,
+			Snake: event.RepoName,
+			Error: event.Reason,
+		})
 	}
+}
 
-	for _, val := range result {
-		fmt.Printf("Registering Repo %v\n", val.Name)
-		docker.RegisterContainer(val.Name)
-		api.RegisterSecret(val.Name, val.Secret)
+// Refresh the state of the running containers and notify about the ones
+// that exited or became unhealthy since they were last checked. Nothing is
+// done while docker events keep the states up to date.
+func checkContainersJob(ctx context.Context) {
+	if docker.EventsConnected() {
+		return
 	}
+	running := map[string]docker.ContainerState{}
+	docker.IterContainers(func(name string, container docker.ContainerState) bool {
+		if container.Running && !container.Paused {
+			running[name] = container
+		}
+		return true
+	})
 
-	// Deploy any non-existing repos
-	for _, val := range result {
-		containerName := docker.RepoNameToContainerName(val.Name)
-		_, err := docker.CheckContainer(containerName)
+	for name, before := range running {
+		_, err := docker.CheckContainer(name)
+		if err != nil && err != docker.ErrorDoesNotExist {
+			slog.ErrorContext(ctx, "Could not check container", "container", name, "error", err)
+			continue
+		}
+		after, err := docker.GetState(name)
 		if err != nil {
-			if err == docker.ErrorDoesNotExist {
-				go api.DeployApplicationPublic(val.Name)
-			} else {
-				fmt.Printf("Could not check %v status:\n", val.Name)
-				fmt.Printf("\t%v\n", err)
+			continue
+		}
+
+		if !after.Running {
+			message := "The container exited"
+			if !after.Exists {
+				message = "The container was removed"
 			}
-		} 
+			notifyContainerEvent(docker.ContainerEvent{Kind: docker.ContainerCrashed, Name: name, RepoName: before.RepoName, Reason: message})
+		} else if after.Health == "unhealthy" && before.Health != "unhealthy" {
+			notifyContainerEvent(docker.ContainerEvent{Kind: docker.ContainerUnhealthy, Name: name, RepoName: before.RepoName, Reason: "The health check is failing"})
+		}
 	}
-
-	return nil
 }
 
+// Pause, stop or remove containers that have been idle for longer than
+// their idle policy allows, and wake up containers in a keep-warm window.
 func stopOldContainersJob() time.Duration {
-	toStop := []string{}
+	const (
+		ACTIVE = iota
+		PAUSED
+		STOPPED
+		REMOVED
+	)
+
+	toWarm := []string{}
 	toPause := []string{}
+	toStop := []string{}
+	toRemove := []string{}
 	nextRunner := time.Minute
 
-	const PAUSE_DELAY time.Duration = time.Minute
-	const STOP_DELAY time.Duration = time.Hour
+	policies := idlePolicies()
+	now := time.Now()
+	ctx := logging.With(context.Background(), "job", "idle")
+
+	checkContainersJob(ctx)
 
 	docker.IterContainers(func(name string, container docker.ContainerState) bool {
-		timeSince := time.Now().Sub(time.Time{})
-		if container.LastUsed != nil {
-			timeSince = time.Now().Sub(*container.LastUsed)
+		policy, found := policies[name]
+		if !found {
+			policy = builtinIdlePolicy
+		}
+		if *policy.NeverIdle {
+			return true
 		}
 
-		if container.Running {
-			if !container.Paused {
-				if timeSince < PAUSE_DELAY {
-					nextRunner = min(nextRunner, PAUSE_DELAY-timeSince)
-				} else {
-					toPause = append(toPause, name)
+		level := REMOVED
+		if container.Exists {
+			level = STOPPED
+			if container.Running {
+				level = ACTIVE
+				if container.Paused {
+					level = PAUSED
 				}
+			}
+		}
+
+		// Snakes that are in the middle of a game are pinned in the running state
+		if docker.ActiveGames(name) > 0 {
+			if level != ACTIVE {
+				toWarm = append(toWarm, name)
+			}
+			return true
+		}
+
+		if warm, remaining := policy.KeepingWarm(now); warm {
+			if level != ACTIVE {
+				toWarm = append(toWarm, name)
+			}
+			nextRunner = min(nextRunner, remaining)
+			return true
+		}
+
+		timeSince := now.Sub(time.Time{})
+		if container.LastUsed != nil {
+			timeSince = now.Sub(*container.LastUsed)
+		}
+
+		target := ACTIVE
+		for action, delay := range []time.Duration{
+			PAUSED:  policy.PauseAfter.Duration,
+			STOPPED: policy.StopAfter.Duration,
+			REMOVED: policy.RemoveAfter.Duration,
+		} {
+			if action <= level || delay == 0 {
+				continue
+			}
+			if timeSince < delay {
+				nextRunner = min(nextRunner, delay-timeSince)
 			} else {
-				if timeSince < STOP_DELAY {
-					nextRunner = min(nextRunner, STOP_DELAY-timeSince)
-				} else {
-					toStop = append(toStop, name)
-				}
+				target = action
 			}
 		}
+
+		switch target {
+		case PAUSED:
+			toPause = append(toPause, name)
+		case STOPPED:
+			toStop = append(toStop, name)
+		case REMOVED:
+			toRemove = append(toRemove, name)
+		}
 		return true
 	})
 
+	for _, name := range toWarm {
+		err := docker.EnsureContainerRunning(ctx, name)
+		if err != nil {
+			slog.ErrorContext(ctx, "Could not warm up container", "container", name, "error", err)
+			continue
+		}
+	}
+	for _, name := range toRemove {
+		err := docker.RemoveContainer(name, true)
+		if err != nil {
+			slog.ErrorContext(ctx, "Could not remove idle container", "container", name, "error", err)
+			continue
+		}
+	}
 	for _, name := range toStop {
-		err := docker.StopContainer(name)
+		err := docker.StopContainer(ctx, name)
 		if err != nil {
-			fmt.Printf("While stopping old job %v\n", name)
-			fmt.Printf("\t%v\n", err)
+			slog.ErrorContext(ctx, "Could not stop idle container", "container", name, "error", err)
 			continue
 		}
 	}
 	for _, name := range toPause {
-		err := docker.PauseContainer(name)
+		err := docker.PauseContainer(ctx, name)
 		if err != nil {
-			fmt.Printf("While pausing old job %v\n", name)
-			fmt.Printf("\t%v\n", err)
+			slog.ErrorContext(ctx, "Could not pause idle container", "container", name, "error", err)
 			continue
 		}
 	}
@@ -109,14 +214,29 @@ func stopOldContainersJob() time.Duration {
 }
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+	logging.Setup(logging.Settings{})
+
+	err := store.Load(statePath)
+	if err != nil {
+		slog.Error("Could not load the saved state, continuing without it", "error", err)
+	}
+	go flushOnExit()
+
 	docker.WaitForDockerSocket()
 	time.Sleep(2 * time.Second)
 
-	err := loadConfig()
+	api.SetSnakeRemovedHook(forgetSnakeSettings)
+	err = loadConfig()
 	if err != nil {
 		panic(err)
 	}
 
+	go watchConfig()
+	go docker.WatchEvents(logging.With(context.Background(), "job", "events"), notifyContainerEvent)
+
 	go func() {
 		for {
 			delay := stopOldContainersJob()
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A metric that can be written in the prometheus text format
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry []collector
+var registryMutex sync.Mutex
+
+func register(c collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	registry = append(registry, c)
+}
+
+// Write every registered metric in the prometheus text exposition format
+func WritePrometheus(w io.Writer) {
+	registryMutex.Lock()
+	collectors := slices.Clone(registry)
+	registryMutex.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w)
+	})
+}
+
+var labelEscaper *strings.Replacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format label names and values as {a="1",b="2"}
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts[i] = name + `="` + labelEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// A set of counters partitioned by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+		keys:   map[string][]string{},
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := labelKey(labelValues)
+	if _, found := c.keys[key]; !found {
+		c.keys[key] = slices.Clone(labelValues)
+	}
+	c.values[key] += value
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, formatLabels(c.labels, c.keys[key]), formatFloat(c.values[key]))
+	}
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// A set of histograms partitioned by label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := labelKey(labelValues)
+	hist, found := h.values[key]
+	if !found {
+		hist = &histogramValue{
+			labels: slices.Clone(labelValues),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(slices.Clone(h.labels), "le")
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			labels := formatLabels(bucketLabels, append(slices.Clone(hist.labels), formatFloat(bound)))
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, labels, hist.counts[i])
+		}
+		labels := formatLabels(bucketLabels, append(slices.Clone(hist.labels), "+Inf"))
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, labels, hist.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, formatLabels(h.labels, hist.labels), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, formatLabels(h.labels, hist.labels), hist.count)
+	}
+}
+
+// A gauge whose values are collected when the metrics are scraped
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// Create a gauge that calls collect on every scrape. collect should call emit
+// once for each set of label values.
+func NewGaugeFunc(name string, help string, collect func(emit func(value float64, labelValues ...string)), labels ...string) *GaugeFunc {
+	g := &GaugeFunc{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		collect: collect,
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.collect(func(value float64, labelValues ...string) {
+		fmt.Fprintf(w, "%v%v %v\n", g.name, formatLabels(g.labels, labelValues), formatFloat(value))
+	})
+}
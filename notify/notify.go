@@ -0,0 +1,260 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// The events that notifications can be sent for
+const (
+	EventDeployStarted    = "deploy_started"
+	EventDeploySucceeded  = "deploy_succeeded"
+	EventDeployFailed     = "deploy_failed"
+	EventContainerCrashed = "container_crashed"
+	EventSnakeUnhealthy   = "snake_unhealthy"
+)
+
+// The payload formats a target can receive
+const (
+	FormatGeneric = "generic"
+	FormatSlack   = "slack"
+	FormatDiscord = "discord"
+)
+
+// How many times a notification is sent before giving up
+const maxAttempts int = 4
+
+// How long to wait for a target to respond
+const sendTimeout time.Duration = 10 * time.Second
+
+var defaultMessages map[string]string = map[string]string{
+	EventDeployStarted:    `Deploying {{.Snake}}{{if .Ref}} at {{.Ref}}{{end}}{{if .Url}} {{.Url}}{{end}}`,
+	EventDeploySucceeded:  `Deployed {{.Snake}} at {{short .Commit}}{{if .Url}} {{.Url}}{{end}}`,
+	EventDeployFailed:     `Deploy of {{.Snake}} failed: {{.Error}}{{if .Url}} {{.Url}}{{end}}`,
+	EventContainerCrashed: `{{.Snake}} crashed{{if .Error}}: {{.Error}}{{end}}`,
+	EventSnakeUnhealthy:   `{{.Snake}} is unhealthy{{if .Error}}: {{.Error}}{{end}}`,
+}
+
+var templateFuncs template.FuncMap = template.FuncMap{
+	"json": func(value any) (string, error) {
+		raw, err := json.Marshal(value)
+		return string(raw), err
+	},
+	"short": func(sha string) string {
+		if len(sha) > 7 {
+			return sha[:7]
+		}
+		return sha
+	},
+}
+
+// Something that happened to a snake
+type Event struct {
+	Event    string    `json:"event"`
+	Snake    string    `json:"snake"`
+	Message  string    `json:"message"`
+	DeployID string    `json:"deploy_id,omitempty"`
+	Ref      string    `json:"ref,omitempty"`
+	Commit   string    `json:"commit,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Url      string    `json:"url,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// A url that notifications are posted to. The message of an event is
+// rendered from Message, or the event's default message, with the Event as
+// data. Body replaces the whole payload with its rendered output.
+type Target struct {
+	Url string `json:"url"`
+	// generic (the default), slack or discord. Receivers that accept Slack's
+	// incoming webhooks, such as Matrix hookshot, use slack.
+	Format string `json:"format"`
+	// Only notify about these events, all events if empty
+	Events []string `json:"events"`
+	// Only notify about these snakes, all snakes if empty
+	Snakes  []string `json:"snakes"`
+	Message string   `json:"message"`
+	Body    string   `json:"body"`
+}
+
+type target struct {
+	Target
+	message map[string]*template.Template
+	body    *template.Template
+}
+
+var targets atomic.Pointer[[]target]
+
+func (t Target) Validate() error {
+	parsed, err := url.Parse(t.Url)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return errors.New("url must be an http url")
+	}
+	switch t.Format {
+	case "", FormatGeneric, FormatSlack, FormatDiscord:
+	default:
+		return fmt.Errorf("Unknown format %q", t.Format)
+	}
+	for _, event := range t.Events {
+		if _, found := defaultMessages[event]; !found {
+			return fmt.Errorf("Unknown event %q", event)
+		}
+	}
+	_, err = t.compile()
+	return err
+}
+
+func (t Target) compile() (target, error) {
+	result := target{
+		Target:  t,
+		message: map[string]*template.Template{},
+	}
+	for event, message := range defaultMessages {
+		if t.Message != "" {
+			message = t.Message
+		}
+		tmpl, err := template.New(event).Funcs(templateFuncs).Parse(message)
+		if err != nil {
+			return result, fmt.Errorf("Invalid message template: %w", err)
+		}
+		result.message[event] = tmpl
+	}
+	if t.Body != "" {
+		tmpl, err := template.New("body").Funcs(templateFuncs).Parse(t.Body)
+		if err != nil {
+			return result, fmt.Errorf("Invalid body template: %w", err)
+		}
+		result.body = tmpl
+	}
+	return result, nil
+}
+
+// Replace the targets that notifications are sent to
+func Setup(settings []Target) error {
+	compiled := []target{}
+	for _, t := range settings {
+		result, err := t.compile()
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, result)
+	}
+	targets.Store(&compiled)
+	return nil
+}
+
+func (t target) wants(event Event) bool {
+	if len(t.Events) > 0 && !slices.Contains(t.Events, event.Event) {
+		return false
+	}
+	if len(t.Snakes) > 0 && !slices.Contains(t.Snakes, event.Snake) {
+		return false
+	}
+	return true
+}
+
+// Render the payload of an event
+func (t target) payload(event Event) ([]byte, error) {
+	var message strings.Builder
+	if err := t.message[event.Event].Execute(&message, event); err != nil {
+		return nil, err
+	}
+	event.Message = message.String()
+
+	if t.body != nil {
+		var body bytes.Buffer
+		if err := t.body.Execute(&body, event); err != nil {
+			return nil, err
+		}
+		if !json.Valid(body.Bytes()) {
+			return nil, errors.New("The body template did not produce valid json")
+		}
+		return body.Bytes(), nil
+	}
+
+	switch t.Format {
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": event.Message})
+	case FormatDiscord:
+		return json.Marshal(map[string]string{"content": event.Message})
+	}
+	return json.Marshal(event)
+}
+
+// Send an event to every target that wants it. Notifications are delivered in
+// the background.
+func Send(ctx context.Context, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	loaded := targets.Load()
+	if loaded == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	for _, t := range *loaded {
+		if !t.wants(event) {
+			continue
+		}
+		body, err := t.payload(event)
+		if err != nil {
+			slog.ErrorContext(ctx, "Could not render notification", "event", event.Event, "url", t.Url, "error", err)
+			continue
+		}
+		go deliver(ctx, t.Url, event.Event, body)
+	}
+}
+
+// Post a notification, retrying with backoff when the target fails
+func deliver(ctx context.Context, target string, event string, body []byte) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := post(ctx, target, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= maxAttempts {
+			slog.ErrorContext(ctx, "Could not send notification", "event", event, "url", target, "attempts", attempt, "error", err)
+			return
+		}
+		slog.WarnContext(ctx, "Could not send notification, retrying", "event", event, "url", target, "attempt", attempt, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Post a payload once. Returns whether a failure is worth retrying.
+func post(ctx context.Context, target string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("Returned Status Code %v", resp.StatusCode)
+	return resp.StatusCode == 429 || resp.StatusCode >= 500, err
+}
@@ -0,0 +1,240 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The moves a snake can make
+const (
+	MoveUp    = "up"
+	MoveDown  = "down"
+	MoveLeft  = "left"
+	MoveRight = "right"
+)
+
+var Moves []string = []string{MoveUp, MoveDown, MoveLeft, MoveRight}
+
+// How much health hazards take each turn when the ruleset does not say
+const defaultHazardDamage int = 14
+
+const maxHealth int = 100
+
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type Snake struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Health int     `json:"health"`
+	Body   []Point `json:"body"`
+	Head   Point   `json:"head"`
+	Length int     `json:"length"`
+}
+
+type Board struct {
+	Height  int     `json:"height"`
+	Width   int     `json:"width"`
+	Food    []Point `json:"food"`
+	Hazards []Point `json:"hazards"`
+	Snakes  []Snake `json:"snakes"`
+}
+
+type Ruleset struct {
+	Name     string `json:"name"`
+	Settings struct {
+		HazardDamagePerTurn int `json:"hazardDamagePerTurn"`
+	} `json:"settings"`
+}
+
+// The body of a /start, /move or /end request
+type GameState struct {
+	Game struct {
+		ID      string  `json:"id"`
+		Ruleset Ruleset `json:"ruleset"`
+		Timeout int     `json:"timeout"`
+	} `json:"game"`
+	Turn  int   `json:"turn"`
+	Board Board `json:"board"`
+	You   Snake `json:"you"`
+}
+
+// The body of a /move response
+type MoveResponse struct {
+	Move  string `json:"move"`
+	Shout string `json:"shout,omitempty"`
+}
+
+func ParseGameState(body []byte) (GameState, error) {
+	var state GameState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return state, err
+	}
+	if len(state.You.Body) == 0 {
+		return state, fmt.Errorf("The request has no snake")
+	}
+	return state, nil
+}
+
+// Parse the move out of a /move response, empty if there is none
+func ParseMove(body []byte) string {
+	var response MoveResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return ""
+	}
+	return response.Move
+}
+
+// What would happen if the snake made a move
+type Verdict struct {
+	// The move is not a move, or turns back into the snake's own neck
+	Illegal bool `json:"illegal"`
+	// The snake dies by making the move
+	Fatal bool `json:"fatal"`
+	// The snake could die in a head-to-head collision
+	Risky  bool   `json:"risky"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (s GameState) wrapped() bool {
+	return s.Game.Ruleset.Name == "wrapped" && s.Board.Width > 0 && s.Board.Height > 0
+}
+
+// The point next to p in the direction of move
+func (s GameState) step(p Point, move string) Point {
+	switch move {
+	case MoveUp:
+		p.Y++
+	case MoveDown:
+		p.Y--
+	case MoveLeft:
+		p.X--
+	case MoveRight:
+		p.X++
+	}
+	if s.wrapped() {
+		p.X = (p.X + s.Board.Width) % s.Board.Width
+		p.Y = (p.Y + s.Board.Height) % s.Board.Height
+	}
+	return p
+}
+
+func (s GameState) inBounds(p Point) bool {
+	return p.X >= 0 && p.Y >= 0 && p.X < s.Board.Width && p.Y < s.Board.Height
+}
+
+func contains(points []Point, p Point) bool {
+	for _, other := range points {
+		if other == p {
+			return true
+		}
+	}
+	return false
+}
+
+func isMove(move string) bool {
+	for _, other := range Moves {
+		if other == move {
+			return true
+		}
+	}
+	return false
+}
+
+func length(snake Snake) int {
+	if snake.Length > 0 {
+		return snake.Length
+	}
+	return len(snake.Body)
+}
+
+// Work out what happens to the requesting snake if it makes move, assuming
+// the other snakes make safe moves
+func (s GameState) Check(move string) Verdict {
+	you := s.You
+	if !isMove(move) {
+		return Verdict{Illegal: true, Fatal: true, Reason: fmt.Sprintf("%q is not a move", move)}
+	}
+	target := s.step(you.Body[0], move)
+	if len(you.Body) > 1 && target == you.Body[1] && you.Body[1] != you.Body[0] {
+		return Verdict{Illegal: true, Fatal: true, Reason: "Moves back into its own neck"}
+	}
+	if !s.inBounds(target) {
+		return Verdict{Fatal: true, Reason: "Moves off the board"}
+	}
+
+	eats := contains(s.Board.Food, target)
+	health := you.Health - 1
+	if contains(s.Board.Hazards, target) && !eats {
+		damage := s.Game.Ruleset.Settings.HazardDamagePerTurn
+		if damage == 0 {
+			damage = defaultHazardDamage
+		}
+		health -= damage
+	}
+	if eats {
+		health = maxHealth
+	}
+	if health <= 0 {
+		return Verdict{Fatal: true, Reason: "Runs out of health"}
+	}
+
+	for _, snake := range s.Board.Snakes {
+		body := snake.Body
+		if len(body) == 0 {
+			continue
+		}
+		// Tails move unless the snake just ate. Our own head moves away, but
+		// another snake's head becomes its neck.
+		end := len(body)
+		if end > 1 && body[end-1] != body[end-2] {
+			end--
+		}
+		begin := 0
+		if snake.ID == you.ID {
+			begin = 1
+		}
+		for _, p := range body[begin:end] {
+			if p != target {
+				continue
+			}
+			if snake.ID == you.ID {
+				return Verdict{Fatal: true, Reason: "Runs into its own body"}
+			}
+			return Verdict{Fatal: true, Reason: fmt.Sprintf("Runs into %v", snake.Name)}
+		}
+	}
+
+	for _, snake := range s.Board.Snakes {
+		if snake.ID == you.ID || len(snake.Body) == 0 || length(snake) < length(you) {
+			continue
+		}
+		for _, other := range Moves {
+			if s.step(snake.Body[0], other) == target {
+				return Verdict{Risky: true, Reason: fmt.Sprintf("May lose a head-to-head with %v", snake.Name)}
+			}
+		}
+	}
+	return Verdict{}
+}
+
+// The moves that do not kill the snake, the ones without head-to-head risk
+// first. Empty if every move is fatal.
+func (s GameState) SafeMoves() []string {
+	safe := []string{}
+	risky := []string{}
+	for _, move := range Moves {
+		verdict := s.Check(move)
+		if verdict.Fatal {
+			continue
+		}
+		if verdict.Risky {
+			risky = append(risky, move)
+		} else {
+			safe = append(safe, move)
+		}
+	}
+	return append(safe, risky...)
+}
@@ -0,0 +1,243 @@
+package rules
+
+import (
+	"slices"
+	"testing"
+)
+
+func point(x, y int) Point {
+	return Point{X: x, Y: y}
+}
+
+func snake(id string, health int, body ...Point) Snake {
+	return Snake{ID: id, Name: id, Health: health, Body: body, Head: body[0], Length: len(body)}
+}
+
+// A game on an 11x11 board where you is the first snake
+func game(ruleset string, snakes ...Snake) GameState {
+	var state GameState
+	state.Game.Ruleset.Name = ruleset
+	state.Board = Board{Width: 11, Height: 11, Snakes: snakes}
+	state.You = snakes[0]
+	return state
+}
+
+func TestCheck(t *testing.T) {
+	you := snake("you", 90, point(5, 5), point(5, 4), point(5, 3))
+
+	withHazard := game("standard", you)
+	withHazard.Board.Hazards = []Point{point(6, 5)}
+	weak := game("standard", snake("you", 10, point(5, 5), point(5, 4), point(5, 3)))
+	weak.Board.Hazards = []Point{point(6, 5), point(4, 5)}
+	weak.Board.Food = []Point{point(4, 5)}
+	customDamage := game("standard", you)
+	customDamage.Board.Hazards = []Point{point(6, 5)}
+	customDamage.Game.Ruleset.Settings.HazardDamagePerTurn = 100
+
+	tests := []struct {
+		name  string
+		state GameState
+		move  string
+		want  Verdict
+	}{
+		{
+			name:  "free cell",
+			state: game("standard", you),
+			move:  MoveUp,
+			want:  Verdict{},
+		},
+		{
+			name:  "not a move",
+			state: game("standard", you),
+			move:  "sideways",
+			want:  Verdict{Illegal: true, Fatal: true},
+		},
+		{
+			name:  "own neck",
+			state: game("standard", you),
+			move:  MoveDown,
+			want:  Verdict{Illegal: true, Fatal: true},
+		},
+		{
+			name:  "off the board",
+			state: game("standard", snake("you", 90, point(0, 5), point(1, 5), point(2, 5))),
+			move:  MoveLeft,
+			want:  Verdict{Fatal: true},
+		},
+		{
+			name:  "wrapped board",
+			state: game("wrapped", snake("you", 90, point(0, 5), point(1, 5), point(2, 5))),
+			move:  MoveLeft,
+			want:  Verdict{},
+		},
+		{
+			name: "wrapped into a body",
+			state: game("wrapped",
+				snake("you", 90, point(0, 5), point(1, 5), point(2, 5)),
+				snake("other", 90, point(10, 6), point(10, 5), point(10, 4), point(10, 3)),
+			),
+			move: MoveLeft,
+			want: Verdict{Fatal: true},
+		},
+		{
+			name: "another snake's head",
+			state: game("standard",
+				you,
+				snake("other", 90, point(6, 5), point(7, 5), point(8, 5)),
+			),
+			move: MoveRight,
+			want: Verdict{Fatal: true},
+		},
+		{
+			name: "another snake's body",
+			state: game("standard",
+				you,
+				snake("other", 90, point(6, 7), point(6, 6), point(6, 5), point(6, 4)),
+			),
+			move: MoveRight,
+			want: Verdict{Fatal: true},
+		},
+		{
+			name: "moving tail",
+			state: game("standard",
+				you,
+				snake("other", 90, point(8, 5), point(7, 5), point(6, 5)),
+			),
+			move: MoveRight,
+			want: Verdict{},
+		},
+		{
+			name: "stacked tail of a snake that just ate",
+			state: game("standard",
+				you,
+				snake("other", 90, point(8, 5), point(7, 5), point(6, 5), point(6, 5)),
+			),
+			move: MoveRight,
+			want: Verdict{Fatal: true},
+		},
+		{
+			name:  "own stacked tail",
+			state: game("standard", snake("you", 90, point(5, 5), point(5, 4), point(4, 4), point(4, 5), point(4, 5))),
+			move:  MoveLeft,
+			want:  Verdict{Fatal: true},
+		},
+		{
+			name:  "own moving tail",
+			state: game("standard", snake("you", 90, point(5, 5), point(5, 4), point(4, 4), point(4, 5))),
+			move:  MoveLeft,
+			want:  Verdict{},
+		},
+		{
+			name: "head-to-head with a longer snake",
+			state: game("standard",
+				you,
+				snake("other", 90, point(7, 5), point(8, 5), point(9, 5), point(10, 5)),
+			),
+			move: MoveRight,
+			want: Verdict{Risky: true},
+		},
+		{
+			name: "head-to-head with a shorter snake",
+			state: game("standard",
+				you,
+				snake("other", 90, point(7, 5), point(8, 5)),
+			),
+			move: MoveRight,
+			want: Verdict{},
+		},
+		{
+			name:  "hazard",
+			state: withHazard,
+			move:  MoveRight,
+			want:  Verdict{},
+		},
+		{
+			name:  "hazard without enough health",
+			state: weak,
+			move:  MoveRight,
+			want:  Verdict{Fatal: true},
+		},
+		{
+			name:  "food in a hazard",
+			state: weak,
+			move:  MoveLeft,
+			want:  Verdict{},
+		},
+		{
+			name:  "custom hazard damage",
+			state: customDamage,
+			move:  MoveRight,
+			want:  Verdict{Fatal: true},
+		},
+		{
+			name:  "out of health",
+			state: game("standard", snake("you", 1, point(5, 5), point(5, 4), point(5, 3))),
+			move:  MoveUp,
+			want:  Verdict{Fatal: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.state.Check(test.move)
+			got.Reason = ""
+			if got != test.want {
+				t.Errorf("Check(%v) = %+v, want %+v", test.move, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSafeMoves(t *testing.T) {
+	tests := []struct {
+		name  string
+		state GameState
+		want  []string
+	}{
+		{
+			name:  "open board",
+			state: game("standard", snake("you", 90, point(5, 5), point(5, 4), point(5, 3))),
+			want:  []string{MoveUp, MoveLeft, MoveRight},
+		},
+		{
+			name:  "corner",
+			state: game("standard", snake("you", 90, point(0, 10), point(0, 9), point(0, 8))),
+			want:  []string{MoveRight},
+		},
+		{
+			name: "next to another snake's head",
+			state: game("standard",
+				snake("you", 90, point(5, 5), point(5, 4), point(5, 3)),
+				snake("other", 90, point(6, 5), point(6, 6), point(6, 7)),
+			),
+			want: []string{MoveUp, MoveLeft},
+		},
+		{
+			name: "risky moves last",
+			state: game("standard",
+				snake("you", 90, point(5, 5), point(5, 4), point(5, 3)),
+				snake("other", 90, point(5, 7), point(5, 8), point(5, 9), point(5, 10)),
+			),
+			want: []string{MoveLeft, MoveRight, MoveUp},
+		},
+		{
+			name:  "trapped",
+			state: game("standard", snake("you", 90, point(0, 0), point(1, 0), point(1, 1), point(0, 1), point(0, 1))),
+			want:  []string{},
+		},
+		{
+			name:  "wrapped corner",
+			state: game("wrapped", snake("you", 90, point(0, 10), point(0, 9), point(0, 8))),
+			want:  []string{MoveUp, MoveLeft, MoveRight},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.state.SafeMoves()
+			if !slices.Equal(got, test.want) {
+				t.Errorf("SafeMoves() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
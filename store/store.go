@@ -0,0 +1,202 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The outcome of a deploy
+const (
+	DeployRunning   = "running"
+	DeploySucceeded = "succeeded"
+	DeployFailed    = "failed"
+	DeployCancelled = "cancelled"
+)
+
+// Passed to FinishDeploy when a deploy was cancelled before it finished
+var ErrorCancelled = errors.New("The deploy was cancelled")
+
+// How many deploys are remembered for each snake
+const maxDeployHistory int = 20
+
+// How long to wait after a change before writing the store to disk
+const flushDelay time.Duration = 2 * time.Second
+
+type Deploy struct {
+	ID       string     `json:"id"`
+	Commit   string     `json:"commit,omitempty"`
+	ImageID  string     `json:"image_id,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Outcome  string     `json:"outcome"`
+	Error    string     `json:"error,omitempty"`
+	// What started the deploy, such as a push or the admin api
+	Trigger string `json:"trigger,omitempty"`
+	// Whether this deploy reused an earlier image instead of building one
+	Rollback bool `json:"rollback,omitempty"`
+}
+
+type Snake struct {
+	LastUsed   *time.Time `json:"last_used,omitempty"`
+	Commit     string     `json:"commit,omitempty"`
+	ImageID    string     `json:"image_id,omitempty"`
+	DeployedAt *time.Time `json:"deployed_at,omitempty"`
+	Deploys    []Deploy   `json:"deploys,omitempty"`
+}
+
+var snakes map[string]Snake = map[string]Snake{}
+var storePath string = ""
+var storeMutex sync.Mutex
+var flushPending bool
+
+// Load the store from disk. Changes made afterwards will be written back to
+// the same path. A missing file is treated as an empty store.
+func Load(path string) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	storePath = path
+	body, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var result map[string]Snake
+	if err = json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("Could not parse %v: %w", path, err)
+	}
+	if result != nil {
+		snakes = result
+	}
+	return nil
+}
+
+// Get a copy of what is known about a snake by its container name
+func Get(name string) (Snake, bool) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	snake, found := snakes[name]
+	snake.Deploys = append([]Deploy(nil), snake.Deploys...)
+	return snake, found
+}
+
+// Modify the stored state of a snake. The change is written to disk shortly
+// after.
+func Update(name string, update func(snake *Snake)) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	snake := snakes[name]
+	update(&snake)
+	if len(snake.Deploys) > maxDeployHistory {
+		snake.Deploys = snake.Deploys[len(snake.Deploys)-maxDeployHistory:]
+	}
+	snakes[name] = snake
+
+	if !flushPending && storePath != "" {
+		flushPending = true
+		time.AfterFunc(flushDelay, func() {
+			if err := Flush(); err != nil {
+				slog.Error("Could not save the state store", "error", err)
+			}
+		})
+	}
+}
+
+// Record the start of a deploy
+func StartDeploy(name string, id string) {
+	Update(name, func(snake *Snake) {
+		snake.Deploys = append(snake.Deploys, Deploy{
+			ID:      id,
+			Started: time.Now(),
+			Outcome: DeployRunning,
+		})
+	})
+}
+
+// Modify a deploy that was recorded with StartDeploy
+func UpdateDeploy(name string, id string, update func(deploy *Deploy)) {
+	Update(name, func(snake *Snake) {
+		for i := range snake.Deploys {
+			if snake.Deploys[i].ID == id {
+				update(&snake.Deploys[i])
+				return
+			}
+		}
+	})
+}
+
+// Record the outcome of a deploy. If it succeeded, the deployed commit and
+// image become the snake's current ones. ErrorCancelled marks the deploy as
+// cancelled rather than failed.
+func FinishDeploy(name string, id string, deployErr error) {
+	Update(name, func(snake *Snake) {
+		now := time.Now()
+		for i := range snake.Deploys {
+			deploy := &snake.Deploys[i]
+			if deploy.ID != id {
+				continue
+			}
+			deploy.Finished = &now
+			if deployErr == ErrorCancelled {
+				deploy.Outcome = DeployCancelled
+				return
+			}
+			if deployErr != nil {
+				deploy.Outcome = DeployFailed
+				deploy.Error = deployErr.Error()
+				return
+			}
+			deploy.Outcome = DeploySucceeded
+			snake.Commit = deploy.Commit
+			snake.ImageID = deploy.ImageID
+			snake.DeployedAt = &now
+			return
+		}
+	})
+}
+
+// Write the store to disk. The file is replaced atomically so that a crash
+// never leaves a partially written store behind.
+func Flush() error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	flushPending = false
+	if storePath == "" {
+		return nil
+	}
+
+	body, err := json.MarshalIndent(snakes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(storePath), filepath.Base(storePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), storePath)
+}